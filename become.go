@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Tasks run as another user with become, set on a play or a task, the task's
+// settings take precedence:
+//
+//	become: true
+//	become_user: postgres  # root unless set
+//	become_method: sudo    # sudo (the default), su or doas
+//
+// The password, when one is asked for, comes from the become_password var.
+// sudo reads it on stdin so the command's stderr stays separate, su and doas
+// only read from a terminal so they're run with a PTY, which merges stderr
+// into stdout. The command first echoes a marker, anything before it is the
+// escalation tool talking. A password prompt without a become_password, or a
+// second prompt after it was sent, fails the task straight away with an
+// AuthFailure rather than waiting on a prompt nobody will answer.
+const (
+	SudoBecome = "sudo"
+	SuBecome   = "su"
+	DoasBecome = "doas"
+)
+
+// How long to wait for the command to start as the become user before giving
+// up on the escalation tool
+const becomeTimeout = 20 * time.Second
+
+// Prompts from su and doas, which can't be told what to print
+var becomePromptPattern = regexp.MustCompile(`(?i)(password|passphrase)[^\n]*:\s*$`)
+
+// Become is the privilege escalation for a single command
+type Become struct {
+	User     string
+	Method   string
+	Password string
+}
+
+// validateBecomeMethod checks a become_method, one which is a template is
+// checked once it's rendered
+func validateBecomeMethod(method string) error {
+	switch method {
+	case "", SudoBecome, SuBecome, DoasBecome:
+		return nil
+	}
+	if strings.Contains(method, "{{") {
+		return nil
+	}
+	return fmt.Errorf("become_method should be %v, %v or %v, got: %v",
+		SudoBecome, SuBecome, DoasBecome, method)
+}
+
+// taskBecome returns how a rendered task escalates privileges on a host, nil
+// when it runs as the connecting user. The play's settings are rendered
+// against the host's vars, the task's already have been
+func (p Playbook) taskBecome(task CommandTask, vars map[string]interface{}) (*Become, error) {
+	become := p.Become != nil && *p.Become
+	if task.Become != nil {
+		become = *task.Become
+	}
+	if !become {
+		return nil, nil
+	}
+	playUser, err := renderTemplate("become_user", p.BecomeUser, vars)
+	if err != nil {
+		return nil, err
+	}
+	playMethod, err := renderTemplate("become_method", p.BecomeMethod, vars)
+	if err != nil {
+		return nil, err
+	}
+	settings := &Become{User: "root", Method: SudoBecome}
+	for _, user := range []string{playUser, task.BecomeUser} {
+		if user != "" {
+			settings.User = user
+		}
+	}
+	for _, method := range []string{playMethod, task.BecomeMethod} {
+		if method != "" {
+			settings.Method = method
+		}
+	}
+	if settings.Method != SudoBecome && settings.Method != SuBecome && settings.Method != DoasBecome {
+		return nil, fmt.Errorf("unsupported become_method %q", settings.Method)
+	}
+	settings.Password, _ = stringVar(vars, "become_password")
+	return settings, nil
+}
+
+// becomeCommand wraps command so it runs as the become user, returning the
+// wrapped command and whether it needs a PTY
+func becomeCommand(command string, become *Become, marker, prompt string) (string, bool) {
+	inner := fmt.Sprintf("echo %v; %v", marker, command)
+	switch become.Method {
+	case SuBecome:
+		return fmt.Sprintf("su %v -c %v", quoteFilter(become.User), quoteFilter(inner)), true
+	case DoasBecome:
+		return fmt.Sprintf("doas -u %v /bin/sh -c %v", quoteFilter(become.User), quoteFilter(inner)), true
+	}
+	return fmt.Sprintf("sudo -H -S -p %v -u %v /bin/sh -c %v",
+		quoteFilter(prompt), quoteFilter(become.User), quoteFilter(inner)), false
+}
+
+func becomeToken(kind string) string {
+	random := make([]byte, 8)
+	rand.Read(random)
+	return fmt.Sprintf("goat-become-%v-%v", kind, hex.EncodeToString(random))
+}
+
+// becomeWatcher sits between a remote command and its output, answering the
+// password prompt and stripping everything before the command started
+type becomeWatcher struct {
+	mutex    sync.Mutex
+	become   *Become
+	marker   string
+	prompt   string
+	pty      bool
+	stdin    io.Writer
+	stdout   bytes.Buffer
+	stderr   bytes.Buffer
+	preamble bytes.Buffer
+	// Where in the preamble the last prompt was answered
+	answered   int
+	prompts    int
+	escalated  bool
+	started    chan struct{}
+	failed     chan error
+	failedOnce sync.Once
+}
+
+func newBecomeWatcher(become *Become, marker, prompt string, pty bool, stdin io.Writer) *becomeWatcher {
+	return &becomeWatcher{
+		become:  become,
+		marker:  marker,
+		prompt:  prompt,
+		pty:     pty,
+		stdin:   stdin,
+		started: make(chan struct{}),
+		failed:  make(chan error, 1),
+	}
+}
+
+func (b *becomeWatcher) fail(err error) {
+	b.failedOnce.Do(func() {
+		b.failed <- err
+	})
+}
+
+// Stdout and Stderr are the writers for the session's output
+func (b *becomeWatcher) Stdout() io.Writer {
+	return becomeStream{watcher: b, stdout: true}
+}
+
+func (b *becomeWatcher) Stderr() io.Writer {
+	return becomeStream{watcher: b}
+}
+
+type becomeStream struct {
+	watcher *becomeWatcher
+	stdout  bool
+}
+
+func (s becomeStream) Write(data []byte) (int, error) {
+	b := s.watcher
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if !s.stdout {
+		b.stderr.Write(data)
+		if !b.escalated && !b.pty {
+			b.checkPrompt(strings.Count(b.stderr.String(), b.prompt))
+		}
+		return len(data), nil
+	}
+	if b.escalated {
+		b.stdout.Write(data)
+		return len(data), nil
+	}
+
+	b.preamble.Write(data)
+	preamble := b.preamble.String()
+	if index := strings.Index(preamble, b.marker+"\n"); index >= 0 {
+		b.escalated = true
+		close(b.started)
+		b.stdout.WriteString(preamble[index+len(b.marker)+1:])
+		return len(data), nil
+	}
+	if index := strings.Index(preamble, b.marker+"\r\n"); index >= 0 {
+		b.escalated = true
+		close(b.started)
+		b.stdout.WriteString(preamble[index+len(b.marker)+2:])
+		return len(data), nil
+	}
+	if b.pty && becomePromptPattern.MatchString(preamble[b.answered:]) {
+		b.answered = len(preamble)
+		b.checkPrompt(b.prompts + 1)
+	}
+	return len(data), nil
+}
+
+// checkPrompt answers the first password prompt, and fails on any after it
+func (b *becomeWatcher) checkPrompt(prompts int) {
+	if prompts <= b.prompts {
+		return
+	}
+	b.prompts = prompts
+	if b.become.Password == "" {
+		b.fail(fmt.Errorf("%v asked for a password to become %v but no become_password is set",
+			b.become.Method, b.become.User))
+		return
+	}
+	if b.prompts > 1 {
+		b.fail(fmt.Errorf("Incorrect become_password for %v to become %v",
+			b.become.Method, b.become.User))
+		return
+	}
+	if _, err := io.WriteString(b.stdin, b.become.Password+"\n"); err != nil {
+		b.fail(err)
+	}
+}
+
+// notStarted is the error when the command exited without ever running as the
+// become user, usually an authentication failure
+func (b *becomeWatcher) notStarted() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	output := strings.TrimSpace(b.cleanOutput(b.preamble.String() + b.stderr.String()))
+	if output == "" {
+		return fmt.Errorf("Failed to become %v with %v", b.become.User, b.become.Method)
+	}
+	return fmt.Errorf("Failed to become %v with %v: %v", b.become.User, b.become.Method, output)
+}
+
+// output returns the command's stdout and stderr with the escalation tool's
+// prompts removed
+func (b *becomeWatcher) output() (bytes.Buffer, bytes.Buffer) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	var stdout, stderr bytes.Buffer
+	stdout.WriteString(b.cleanOutput(b.stdout.String()))
+	stderr.WriteString(b.cleanOutput(b.stderr.String()))
+	return stdout, stderr
+}
+
+func (b *becomeWatcher) cleanOutput(output string) string {
+	output = strings.ReplaceAll(output, b.prompt, "")
+	if b.pty {
+		output = strings.ReplaceAll(output, "\r\n", "\n")
+	}
+	return output
+}
+
+var errBecomeTimeout = errors.New("Timed out waiting for privilege escalation")
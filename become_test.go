@@ -0,0 +1,146 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Stand ins for sudo and su which accept the password "correct"
+var fakeSudo = `#!/bin/sh
+# sudo -H -S -p PROMPT -u USER /bin/sh -c COMMAND
+tries=0
+while [ $tries -lt 3 ]; do
+	printf '%s' "$4" >&2
+	read -r password || exit 1
+	if [ "$password" = "correct" ]; then
+		exec /bin/sh -c "$9"
+	fi
+	echo "Sorry, try again." >&2
+	tries=$((tries+1))
+done
+exit 1
+`
+
+var fakeSu = `#!/bin/sh
+# su USER -c COMMAND
+printf 'Password: '
+read -r password || exit 1
+if [ "$password" = "correct" ]; then
+	exec /bin/sh -c "$3"
+fi
+echo "su: Authentication failure"
+exit 1
+`
+
+func installFakeBecome(t *testing.T) {
+	bin := t.TempDir()
+	for name, script := range map[string]string{"sudo": fakeSudo, "su": fakeSu} {
+		if err := os.WriteFile(filepath.Join(bin, name), []byte(script), 0755); err != nil {
+			t.Fatalf("Unable to write fake %v: %v\n", name, err)
+		}
+	}
+	t.Setenv("PATH", bin+":"+os.Getenv("PATH"))
+}
+
+func connectToTestServer(t *testing.T) *SSHConnection {
+	t.Setenv("SSH_AUTH_SOCK", "")
+	port, _ := startTestSSHServer(t, acceptPassword(), nil)
+	conn := &SSHConnection{}
+	err := conn.Connect(testHost(map[string]interface{}{
+		"username":          "deploy",
+		"password":          "secret",
+		"port":              port,
+		"host_key_checking": "off",
+	}))
+	if err != nil {
+		t.Fatalf("Unable to connect to test server: %v\n", err)
+	}
+	t.Cleanup(func() { conn.Client.Close() })
+	return conn
+}
+
+func TestTaskBecome(t *testing.T) {
+	yes, no := true, false
+	play := Playbook{Become: &yes, BecomeUser: "postgres"}
+	vars := map[string]interface{}{"become_password": "hunter2"}
+
+	become, err := play.taskBecome(CommandTask{}, vars)
+	if err != nil || become == nil || *become != (Become{User: "postgres", Method: SudoBecome, Password: "hunter2"}) {
+		t.Fatalf("Expected the play's become settings, got %+v %v\n", become, err)
+	}
+	become, err = play.taskBecome(CommandTask{Become: &no}, vars)
+	if err != nil || become != nil {
+		t.Fatalf("A task should be able to turn become off, got %+v %v\n", become, err)
+	}
+	become, err = Playbook{}.taskBecome(CommandTask{Become: &yes, BecomeMethod: DoasBecome}, vars)
+	if err != nil || become == nil || become.User != "root" || become.Method != DoasBecome {
+		t.Fatalf("Expected the task's become settings, got %+v %v\n", become, err)
+	}
+	_, err = play.taskBecome(CommandTask{BecomeMethod: "pbrun"}, vars)
+	if err == nil {
+		t.Fatalf("Expected an error for an unknown become_method\n")
+	}
+
+	// A play's settings may be templates, rendered for each host
+	templated := Playbook{Become: &yes, BecomeUser: "{{ .app_user }}", BecomeMethod: "{{ .escalation }}"}
+	vars["app_user"], vars["escalation"] = "deploy", SuBecome
+	become, err = templated.taskBecome(CommandTask{}, vars)
+	if err != nil || become == nil || become.User != "deploy" || become.Method != SuBecome {
+		t.Fatalf("Expected the play's templated become settings, got %+v %v\n", become, err)
+	}
+	vars["escalation"] = "pbrun"
+	become, err = templated.taskBecome(CommandTask{}, vars)
+	if err == nil || become != nil {
+		t.Fatalf("Expected an error for a templated become_method which isn't supported, got %+v %v\n", become, err)
+	}
+
+	_, err = playbookFromContents([]byte("name: bad\nhosts: [all]\nbecome: true\nbecome_method: runas\ntasks: []\n"))
+	if err == nil {
+		t.Fatalf("Expected an error loading an unknown become_method\n")
+	}
+}
+
+func TestSSHRunBecomeSudo(t *testing.T) {
+	installFakeBecome(t)
+	conn := connectToTestServer(t)
+
+	result := conn.Run("echo out; echo err >&2", RunOptions{Become: &Become{User: "root", Method: SudoBecome, Password: "correct"}})
+	if result.Error() != nil {
+		t.Fatalf("Expected sudo to succeed: %v %v\n", result.Error(), result.Stderr())
+	}
+	if result.Stdout() != "out\n" || result.Stderr() != "err\n" {
+		t.Fatalf("Expected only the command's output, got %q and %q\n", result.Stdout(), result.Stderr())
+	}
+
+	result = conn.Run("echo out", RunOptions{Become: &Become{User: "root", Method: SudoBecome, Password: "wrong"}})
+	if result.FailureCategory() != AuthFailure || !strings.Contains(result.Error().Error(), "Incorrect become_password") {
+		t.Fatalf("Expected a wrong password to be an auth failure, got %v\n", result.Error())
+	}
+
+	result = conn.Run("echo out", RunOptions{Become: &Become{User: "root", Method: SudoBecome}})
+	if result.FailureCategory() != AuthFailure || !strings.Contains(result.Error().Error(), "no become_password") {
+		t.Fatalf("Expected a missing password to be an auth failure, got %v\n", result.Error())
+	}
+
+	result = conn.Run("exit 3", RunOptions{Become: &Become{User: "root", Method: SudoBecome, Password: "correct"}})
+	if result.FailureCategory() != CommandFailure || result.ExitCode() != 3 {
+		t.Fatalf("Expected the command's own failure, got %v %v\n", result.Error(), result.ExitCode())
+	}
+}
+
+func TestSSHRunBecomeSu(t *testing.T) {
+	installFakeBecome(t)
+	conn := connectToTestServer(t)
+
+	result := conn.Run("echo out", RunOptions{Become: &Become{User: "postgres", Method: SuBecome, Password: "correct"}})
+	if result.Error() != nil || result.Stdout() != "out\n" {
+		t.Fatalf("Expected su to succeed with only the command's output, got %v %q\n", result.Error(), result.Stdout())
+	}
+
+	result = conn.Run("echo out", RunOptions{Become: &Become{User: "postgres", Method: SuBecome, Password: "wrong"}})
+	if result.FailureCategory() != AuthFailure || !strings.Contains(result.Error().Error(), "Authentication failure") {
+		t.Fatalf("Expected su's failure to be an auth failure, got %v\n", result.Error())
+	}
+}
@@ -0,0 +1,851 @@
+package main
+
+import (
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Conditions are jinja style expressions evaluated against the variables
+// resolved for a host, e.g.
+//
+//	when: os_family == "debian" and not skip_nginx
+//
+// They support and, or, not, the comparisons == != < <= > >=, in and not in,
+// the tests "is defined", "is undefined" and "is none", literals for strings,
+// numbers, lists, true, false and none, attribute and index access like
+// uptime.stdout or ports[0], and the template functions in filters.go, either
+// as filters, stdout | regex_search("ok"), or called directly. Referencing an
+// undefined variable is an error unless it's tested with is defined or given
+// a default.
+//
+// Conditions is a list of conditions which must all be true. In yaml it can
+// be written as either a single condition or a list of them.
+type Conditions []string
+
+func (c *Conditions) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.SequenceNode {
+		var conditions []string
+		if err := value.Decode(&conditions); err != nil {
+			return err
+		}
+		*c = conditions
+		return nil
+	}
+	var condition string
+	if err := value.Decode(&condition); err != nil {
+		return err
+	}
+	*c = Conditions{condition}
+	return nil
+}
+
+// ConditionError is returned when a condition can't be parsed or evaluated
+type ConditionError struct {
+	Condition string
+	Err       error
+}
+
+func (c *ConditionError) Error() string {
+	return fmt.Sprintf("Error evaluating condition %q: %v", c.Condition, c.Err)
+}
+
+// Evaluate returns whether every condition is true. An empty list is true
+func (c Conditions) Evaluate(vars map[string]interface{}) (bool, error) {
+	for _, condition := range c {
+		result, err := evaluateCondition(condition, vars)
+		if err != nil {
+			return false, err
+		}
+		if !result {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func evaluateCondition(condition string, vars map[string]interface{}) (bool, error) {
+	if strings.TrimSpace(condition) == "" {
+		return true, nil
+	}
+	expression, err := parseExpression(condition)
+	if err != nil {
+		return false, &ConditionError{Condition: condition, Err: err}
+	}
+	value, err := expression.eval(vars)
+	if err != nil {
+		return false, &ConditionError{Condition: condition, Err: err}
+	}
+	result, err := truthy(value)
+	if err != nil {
+		return false, &ConditionError{Condition: condition, Err: err}
+	}
+	return result, nil
+}
+
+// undefinedValue stands in for a variable which doesn't exist, so that it
+// can be tested with is defined before it's an error
+type undefinedValue struct {
+	name string
+}
+
+func (u undefinedValue) err() error {
+	return fmt.Errorf("undefined variable %q", u.name)
+}
+
+func truthy(value interface{}) (bool, error) {
+	if undefined, ok := value.(undefinedValue); ok {
+		return false, undefined.err()
+	}
+	if value == nil {
+		return false, nil
+	}
+	reflected := reflect.ValueOf(value)
+	switch reflected.Kind() {
+	case reflect.Bool:
+		return reflected.Bool(), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return reflected.Int() != 0, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return reflected.Uint() != 0, nil
+	case reflect.Float32, reflect.Float64:
+		return reflected.Float() != 0, nil
+	case reflect.String, reflect.Slice, reflect.Map, reflect.Array:
+		return reflected.Len() > 0, nil
+	}
+	return true, nil
+}
+
+type exprToken struct {
+	kind  int
+	value string
+}
+
+const (
+	endToken = iota
+	numberToken
+	stringToken
+	identToken
+	operatorToken
+)
+
+var expressionOperators = map[string]bool{
+	"==": true, "!=": true, "<": true, "<=": true, ">": true, ">=": true,
+	"(": true, ")": true, "[": true, "]": true, ",": true, ".": true, "|": true, "-": true,
+}
+
+func tokenizeExpression(text string) ([]exprToken, error) {
+	tokens := make([]exprToken, 0)
+	runes := []rune(text)
+	for index := 0; index < len(runes); {
+		char := runes[index]
+		switch {
+		case unicode.IsSpace(char):
+			index++
+		case unicode.IsDigit(char):
+			start := index
+			for index < len(runes) && (unicode.IsDigit(runes[index]) || runes[index] == '.') {
+				index++
+			}
+			tokens = append(tokens, exprToken{kind: numberToken, value: string(runes[start:index])})
+		case unicode.IsLetter(char) || char == '_':
+			start := index
+			for index < len(runes) && (unicode.IsLetter(runes[index]) || unicode.IsDigit(runes[index]) || runes[index] == '_') {
+				index++
+			}
+			tokens = append(tokens, exprToken{kind: identToken, value: string(runes[start:index])})
+		case char == '"' || char == '\'':
+			var sb strings.Builder
+			index++
+			for ; index < len(runes) && runes[index] != char; index++ {
+				if runes[index] == '\\' && index+1 < len(runes) {
+					index++
+				}
+				sb.WriteRune(runes[index])
+			}
+			if index >= len(runes) {
+				return nil, fmt.Errorf("unterminated string")
+			}
+			index++
+			tokens = append(tokens, exprToken{kind: stringToken, value: sb.String()})
+		default:
+			operator := string(char)
+			if index+1 < len(runes) {
+				switch pair := string(runes[index : index+2]); pair {
+				case "==", "!=", "<=", ">=":
+					operator = pair
+				}
+			}
+			if !expressionOperators[operator] {
+				return nil, fmt.Errorf("unexpected character %q", operator)
+			}
+			index += len(operator)
+			tokens = append(tokens, exprToken{kind: operatorToken, value: operator})
+		}
+	}
+	return append(tokens, exprToken{kind: endToken}), nil
+}
+
+type exprNode interface {
+	eval(vars map[string]interface{}) (interface{}, error)
+}
+
+type exprParser struct {
+	tokens []exprToken
+	pos    int
+}
+
+func parseExpression(text string) (exprNode, error) {
+	tokens, err := tokenizeExpression(text)
+	if err != nil {
+		return nil, err
+	}
+	parser := &exprParser{tokens: tokens}
+	node, err := parser.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if next := parser.peek(); next.kind != endToken {
+		return nil, fmt.Errorf("unexpected %q", next.value)
+	}
+	return node, nil
+}
+
+func (p *exprParser) peek() exprToken {
+	return p.tokens[p.pos]
+}
+
+func (p *exprParser) next() exprToken {
+	token := p.tokens[p.pos]
+	if token.kind != endToken {
+		p.pos++
+	}
+	return token
+}
+
+func (p *exprParser) isKeyword(keyword string) bool {
+	token := p.peek()
+	return token.kind == identToken && token.value == keyword
+}
+
+func (p *exprParser) isOperator(operator string) bool {
+	token := p.peek()
+	return token.kind == operatorToken && token.value == operator
+}
+
+func (p *exprParser) expectOperator(operator string) error {
+	if !p.isOperator(operator) {
+		return fmt.Errorf("expected %q, got %q", operator, p.peek().value)
+	}
+	p.next()
+	return nil
+}
+
+func (p *exprParser) parseOr() (exprNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.isKeyword("or") {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = logicalNode{operator: "or", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseAnd() (exprNode, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.isKeyword("and") {
+		p.next()
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = logicalNode{operator: "and", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseNot() (exprNode, error) {
+	if p.isKeyword("not") {
+		p.next()
+		operand, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{operand: operand}, nil
+	}
+	return p.parseComparison()
+}
+
+var comparisonOperators = map[string]bool{
+	"==": true, "!=": true, "<": true, "<=": true, ">": true, ">=": true,
+}
+
+func (p *exprParser) parseComparison() (exprNode, error) {
+	left, err := p.parseFilter()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		token := p.peek()
+		switch {
+		case token.kind == operatorToken && comparisonOperators[token.value]:
+			p.next()
+			right, err := p.parseFilter()
+			if err != nil {
+				return nil, err
+			}
+			left = compareNode{operator: token.value, left: left, right: right}
+		case p.isKeyword("in"):
+			p.next()
+			right, err := p.parseFilter()
+			if err != nil {
+				return nil, err
+			}
+			left = inNode{item: left, container: right}
+		case p.isKeyword("not") && p.tokens[p.pos+1].kind == identToken && p.tokens[p.pos+1].value == "in":
+			p.next()
+			p.next()
+			right, err := p.parseFilter()
+			if err != nil {
+				return nil, err
+			}
+			left = notNode{operand: inNode{item: left, container: right}}
+		case p.isKeyword("is"):
+			p.next()
+			negate := false
+			if p.isKeyword("not") {
+				p.next()
+				negate = true
+			}
+			test := p.next()
+			if test.kind != identToken {
+				return nil, fmt.Errorf("expected a test after is, got %q", test.value)
+			}
+			left = testNode{test: test.value, operand: left, negate: negate}
+		default:
+			return left, nil
+		}
+	}
+}
+
+func (p *exprParser) parseFilter() (exprNode, error) {
+	value, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOperator("|") {
+		p.next()
+		name := p.next()
+		if name.kind != identToken {
+			return nil, fmt.Errorf("expected a filter name, got %q", name.value)
+		}
+		args := make([]exprNode, 0)
+		if p.isOperator("(") {
+			args, err = p.parseArgs("(", ")")
+			if err != nil {
+				return nil, err
+			}
+		}
+		value = callNode{name: name.value, args: append(args, value)}
+	}
+	return value, nil
+}
+
+func (p *exprParser) parseUnary() (exprNode, error) {
+	if p.isOperator("-") {
+		p.next()
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return negateNode{operand: operand}, nil
+	}
+	return p.parsePostfix()
+}
+
+func (p *exprParser) parsePostfix() (exprNode, error) {
+	value, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch {
+		case p.isOperator("."):
+			p.next()
+			attribute := p.next()
+			if attribute.kind != identToken && attribute.kind != numberToken {
+				return nil, fmt.Errorf("expected an attribute name, got %q", attribute.value)
+			}
+			value = indexNode{container: value, index: literalNode{value: attribute.value}}
+		case p.isOperator("["):
+			p.next()
+			index, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expectOperator("]"); err != nil {
+				return nil, err
+			}
+			value = indexNode{container: value, index: index}
+		default:
+			return value, nil
+		}
+	}
+}
+
+func (p *exprParser) parsePrimary() (exprNode, error) {
+	token := p.next()
+	switch token.kind {
+	case numberToken:
+		if number, err := strconv.Atoi(token.value); err == nil {
+			return literalNode{value: number}, nil
+		}
+		number, err := strconv.ParseFloat(token.value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", token.value)
+		}
+		return literalNode{value: number}, nil
+	case stringToken:
+		return literalNode{value: token.value}, nil
+	case identToken:
+		switch token.value {
+		case "true", "True":
+			return literalNode{value: true}, nil
+		case "false", "False":
+			return literalNode{value: false}, nil
+		case "none", "None":
+			return literalNode{value: nil}, nil
+		}
+		if p.isOperator("(") {
+			args, err := p.parseArgs("(", ")")
+			if err != nil {
+				return nil, err
+			}
+			return callNode{name: token.value, args: args}, nil
+		}
+		return varNode{name: token.value}, nil
+	case operatorToken:
+		switch token.value {
+		case "(":
+			node, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			return node, p.expectOperator(")")
+		case "[":
+			p.pos--
+			items, err := p.parseArgs("[", "]")
+			if err != nil {
+				return nil, err
+			}
+			return listNode{items: items}, nil
+		}
+	case endToken:
+		return nil, fmt.Errorf("unexpected end of condition")
+	}
+	return nil, fmt.Errorf("unexpected %q", token.value)
+}
+
+func (p *exprParser) parseArgs(open, close string) ([]exprNode, error) {
+	if err := p.expectOperator(open); err != nil {
+		return nil, err
+	}
+	args := make([]exprNode, 0)
+	for !p.isOperator(close) {
+		arg, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+		if !p.isOperator(",") {
+			break
+		}
+		p.next()
+	}
+	return args, p.expectOperator(close)
+}
+
+type literalNode struct {
+	value interface{}
+}
+
+func (l literalNode) eval(vars map[string]interface{}) (interface{}, error) {
+	return l.value, nil
+}
+
+type listNode struct {
+	items []exprNode
+}
+
+func (l listNode) eval(vars map[string]interface{}) (interface{}, error) {
+	list := make([]interface{}, 0, len(l.items))
+	for _, item := range l.items {
+		value, err := evalDefined(item, vars)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, value)
+	}
+	return list, nil
+}
+
+type varNode struct {
+	name string
+}
+
+func (v varNode) eval(vars map[string]interface{}) (interface{}, error) {
+	value, exists := vars[v.name]
+	if !exists {
+		return undefinedValue{name: v.name}, nil
+	}
+	return value, nil
+}
+
+type indexNode struct {
+	container exprNode
+	index     exprNode
+}
+
+func (i indexNode) eval(vars map[string]interface{}) (interface{}, error) {
+	container, err := i.container.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	index, err := evalDefined(i.index, vars)
+	if err != nil {
+		return nil, err
+	}
+	if undefined, ok := container.(undefinedValue); ok {
+		return undefinedValue{name: fmt.Sprintf("%v.%v", undefined.name, index)}, nil
+	}
+	missing := undefinedValue{name: fmt.Sprintf("%v", index)}
+	if name, ok := i.container.(varNode); ok {
+		missing.name = fmt.Sprintf("%v.%v", name.name, index)
+	}
+
+	reflected := reflect.ValueOf(container)
+	switch reflected.Kind() {
+	case reflect.Map:
+		if reflected.Type().Key().Kind() != reflect.String {
+			return missing, nil
+		}
+		element := reflected.MapIndex(reflect.ValueOf(toString(index)).Convert(reflected.Type().Key()))
+		if !element.IsValid() {
+			return missing, nil
+		}
+		return element.Interface(), nil
+	case reflect.Slice, reflect.Array, reflect.String:
+		position, err := strconv.Atoi(toString(index))
+		if err != nil {
+			return nil, fmt.Errorf("list index must be a number, got %v", index)
+		}
+		if position < 0 {
+			position += reflected.Len()
+		}
+		if position < 0 || position >= reflected.Len() {
+			return missing, nil
+		}
+		if reflected.Kind() == reflect.String {
+			return string(reflected.String()[position]), nil
+		}
+		return reflected.Index(position).Interface(), nil
+	}
+	return missing, nil
+}
+
+// evalDefined evaluates a node whose value must not be undefined
+func evalDefined(node exprNode, vars map[string]interface{}) (interface{}, error) {
+	value, err := node.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	if undefined, ok := value.(undefinedValue); ok {
+		return nil, undefined.err()
+	}
+	return value, nil
+}
+
+type logicalNode struct {
+	operator string
+	left     exprNode
+	right    exprNode
+}
+
+func (l logicalNode) eval(vars map[string]interface{}) (interface{}, error) {
+	left, err := l.left.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	leftTruth, err := truthy(left)
+	if err != nil {
+		return nil, err
+	}
+	if (l.operator == "and" && !leftTruth) || (l.operator == "or" && leftTruth) {
+		return leftTruth, nil
+	}
+	right, err := l.right.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	return truthy(right)
+}
+
+type notNode struct {
+	operand exprNode
+}
+
+func (n notNode) eval(vars map[string]interface{}) (interface{}, error) {
+	value, err := n.operand.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	truth, err := truthy(value)
+	return !truth, err
+}
+
+type compareNode struct {
+	operator string
+	left     exprNode
+	right    exprNode
+}
+
+func (c compareNode) eval(vars map[string]interface{}) (interface{}, error) {
+	left, err := evalDefined(c.left, vars)
+	if err != nil {
+		return nil, err
+	}
+	right, err := evalDefined(c.right, vars)
+	if err != nil {
+		return nil, err
+	}
+
+	leftNumber, leftIsNumber := toNumber(left)
+	rightNumber, rightIsNumber := toNumber(right)
+	bothNumbers := leftIsNumber && rightIsNumber
+
+	switch c.operator {
+	case "==":
+		if bothNumbers {
+			return leftNumber == rightNumber, nil
+		}
+		return reflect.DeepEqual(left, right), nil
+	case "!=":
+		if bothNumbers {
+			return leftNumber != rightNumber, nil
+		}
+		return !reflect.DeepEqual(left, right), nil
+	}
+
+	if bothNumbers {
+		switch c.operator {
+		case "<":
+			return leftNumber < rightNumber, nil
+		case "<=":
+			return leftNumber <= rightNumber, nil
+		case ">":
+			return leftNumber > rightNumber, nil
+		case ">=":
+			return leftNumber >= rightNumber, nil
+		}
+	}
+	leftString, leftIsString := left.(string)
+	rightString, rightIsString := right.(string)
+	if !leftIsString || !rightIsString {
+		return nil, fmt.Errorf("can't compare %v %v %v", left, c.operator, right)
+	}
+	switch c.operator {
+	case "<":
+		return leftString < rightString, nil
+	case "<=":
+		return leftString <= rightString, nil
+	case ">":
+		return leftString > rightString, nil
+	case ">=":
+		return leftString >= rightString, nil
+	}
+	return nil, fmt.Errorf("unknown operator %v", c.operator)
+}
+
+func toNumber(value interface{}) (float64, bool) {
+	reflected := reflect.ValueOf(value)
+	switch reflected.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(reflected.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(reflected.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return reflected.Float(), true
+	}
+	return 0, false
+}
+
+type negateNode struct {
+	operand exprNode
+}
+
+func (n negateNode) eval(vars map[string]interface{}) (interface{}, error) {
+	value, err := evalDefined(n.operand, vars)
+	if err != nil {
+		return nil, err
+	}
+	number, isNumber := toNumber(value)
+	if !isNumber {
+		return nil, fmt.Errorf("can't negate %v", value)
+	}
+	return -number, nil
+}
+
+type inNode struct {
+	item      exprNode
+	container exprNode
+}
+
+func (i inNode) eval(vars map[string]interface{}) (interface{}, error) {
+	item, err := evalDefined(i.item, vars)
+	if err != nil {
+		return nil, err
+	}
+	container, err := evalDefined(i.container, vars)
+	if err != nil {
+		return nil, err
+	}
+	reflected := reflect.ValueOf(container)
+	switch reflected.Kind() {
+	case reflect.String:
+		return strings.Contains(reflected.String(), toString(item)), nil
+	case reflect.Map:
+		if reflected.Type().Key().Kind() != reflect.String {
+			return false, nil
+		}
+		return reflected.MapIndex(reflect.ValueOf(toString(item)).Convert(reflected.Type().Key())).IsValid(), nil
+	case reflect.Slice, reflect.Array:
+		itemNumber, itemIsNumber := toNumber(item)
+		for index := 0; index < reflected.Len(); index++ {
+			element := reflected.Index(index).Interface()
+			if elementNumber, elementIsNumber := toNumber(element); itemIsNumber && elementIsNumber {
+				if elementNumber == itemNumber {
+					return true, nil
+				}
+				continue
+			}
+			if reflect.DeepEqual(element, item) {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+	return nil, fmt.Errorf("can't test membership in %v", container)
+}
+
+type testNode struct {
+	test    string
+	operand exprNode
+	negate  bool
+}
+
+func (t testNode) eval(vars map[string]interface{}) (interface{}, error) {
+	value, err := t.operand.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	_, undefined := value.(undefinedValue)
+	var result bool
+	switch t.test {
+	case "defined":
+		result = !undefined
+	case "undefined":
+		result = undefined
+	case "none":
+		if undefined {
+			return nil, value.(undefinedValue).err()
+		}
+		result = value == nil
+	default:
+		return nil, fmt.Errorf("unknown test %q", t.test)
+	}
+	if t.negate {
+		return !result, nil
+	}
+	return result, nil
+}
+
+// callNode calls one of the template functions. When used as a filter the
+// filtered value is the last argument, matching the template pipelines
+type callNode struct {
+	name string
+	args []exprNode
+}
+
+func (c callNode) eval(vars map[string]interface{}) (interface{}, error) {
+	args := make([]interface{}, 0, len(c.args))
+	for index, argNode := range c.args {
+		arg, err := argNode.eval(vars)
+		if err != nil {
+			return nil, err
+		}
+		if undefined, ok := arg.(undefinedValue); ok {
+			// default is the only function which accepts an undefined value
+			if c.name != "default" || index != len(c.args)-1 {
+				return nil, undefined.err()
+			}
+			arg = nil
+		}
+		args = append(args, arg)
+	}
+	return callTemplateFunc(c.name, args)
+}
+
+// callTemplateFunc calls a function from templateFuncs, converting arguments
+// to the function's parameter types where it's possible
+func callTemplateFunc(name string, args []interface{}) (interface{}, error) {
+	function, exists := templateFuncs()[name]
+	if !exists {
+		return nil, fmt.Errorf("unknown function %q", name)
+	}
+	reflected := reflect.ValueOf(function)
+	funcType := reflected.Type()
+	if (!funcType.IsVariadic() && len(args) != funcType.NumIn()) ||
+		(funcType.IsVariadic() && len(args) < funcType.NumIn()-1) {
+		return nil, fmt.Errorf("%v expects %v arguments, got %v", name, funcType.NumIn(), len(args))
+	}
+
+	in := make([]reflect.Value, len(args))
+	for index, arg := range args {
+		var paramType reflect.Type
+		if funcType.IsVariadic() && index >= funcType.NumIn()-1 {
+			paramType = funcType.In(funcType.NumIn() - 1).Elem()
+		} else {
+			paramType = funcType.In(index)
+		}
+		switch {
+		case arg == nil:
+			in[index] = reflect.Zero(paramType)
+		case paramType.Kind() == reflect.String:
+			in[index] = reflect.ValueOf(toString(arg)).Convert(paramType)
+		case reflect.TypeOf(arg).AssignableTo(paramType):
+			in[index] = reflect.ValueOf(arg)
+		case reflect.TypeOf(arg).ConvertibleTo(paramType):
+			in[index] = reflect.ValueOf(arg).Convert(paramType)
+		default:
+			return nil, fmt.Errorf("%v can't accept %v as argument %v", name, arg, index+1)
+		}
+	}
+
+	out := reflected.Call(in)
+	if len(out) == 2 && !out[1].IsNil() {
+		return nil, out[1].Interface().(error)
+	}
+	return out[0].Interface(), nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+var conditionVars = map[string]interface{}{
+	"os_family":  "debian",
+	"skip_nginx": false,
+	"port":       8080,
+	"ratio":      0.5,
+	"ports":      []interface{}{80, 443},
+	"flag":       "yes",
+	"uptime": map[string]interface{}{
+		"rc":     0,
+		"stdout": "up 3 days",
+	},
+	"nothing": nil,
+}
+
+func TestEvaluateConditions(t *testing.T) {
+	cases := map[string]bool{
+		`os_family == "debian" and not skip_nginx`:    true,
+		`os_family == 'redhat' or skip_nginx`:         false,
+		`port > 8000 and port <= 8080`:                true,
+		`ratio < 1`:                                   true,
+		`443 in ports`:                                true,
+		`22 not in ports`:                             true,
+		`"days" in uptime.stdout`:                     true,
+		`uptime.rc != 0`:                              false,
+		`uptime["rc"] == 0 and ports[-1] == 443`:      true,
+		`missing is defined`:                          false,
+		`missing is undefined and uptime is defined`:  true,
+		`uptime.missing is not defined`:               true,
+		`nothing is none`:                             true,
+		`missing | default("x") == "x"`:               true,
+		`uptime.stdout | regex_search("\\d+") == "3"`: true,
+		`upper(os_family) == "DEBIAN"`:                true,
+		`flag | bool`:                                 true,
+		`not (port == 80 or port == 443)`:             true,
+		`-1 < 0`:                                      true,
+		`ports`:                                       true,
+		`"a" in ["a", "b"]`:                           true,
+	}
+	for condition, expected := range cases {
+		result, err := Conditions{condition}.Evaluate(conditionVars)
+		if err != nil {
+			t.Fatalf("Received error when evaluating %v: %v\n", condition, err)
+		}
+		if result != expected {
+			t.Fatalf("Condition %v evaluated to %v, expected %v\n", condition, result, expected)
+		}
+	}
+}
+
+func TestEvaluateConditionsList(t *testing.T) {
+	result, err := Conditions{`port == 8080`, `skip_nginx`}.Evaluate(conditionVars)
+	if err != nil || result {
+		t.Fatalf("Every condition in a list must be true: %v, %v\n", result, err)
+	}
+	result, err = Conditions{}.Evaluate(conditionVars)
+	if err != nil || !result {
+		t.Fatalf("An empty list of conditions should be true: %v, %v\n", result, err)
+	}
+}
+
+func TestEvaluateConditionErrors(t *testing.T) {
+	for _, condition := range []string{
+		`missing == 1`,
+		`not missing`,
+		`port ==`,
+		`port = 8080`,
+		`"unterminated`,
+		`unknown_filter(port)`,
+		`port is odd`,
+	} {
+		_, err := Conditions{condition}.Evaluate(conditionVars)
+		if err == nil {
+			t.Fatalf("Expected an error when evaluating %v\n", condition)
+		}
+		if _, ok := err.(*ConditionError); !ok {
+			t.Fatalf("Error should've been a ConditionError: %v\n", err)
+		}
+	}
+	_, err := Conditions{`missing == 1`}.Evaluate(conditionVars)
+	if !strings.Contains(err.Error(), "missing") {
+		t.Fatalf("Error should name the undefined variable: %v\n", err)
+	}
+}
+
+func TestConditionsFromYAML(t *testing.T) {
+	playbook, err := playbookFromContents([]byte(`
+name: conditions
+hosts: [all]
+tasks:
+  - name: single
+    cmd: whoami
+    when: port == 8080
+  - name: list
+    cmd: whoami
+    when:
+      - port == 8080
+      - not skip_nginx
+`))
+	if err != nil {
+		t.Fatalf("Received error when parsing playbook: %v\n", err)
+	}
+	if len(playbook.Tasks[0].When) != 1 || len(playbook.Tasks[1].When) != 2 {
+		t.Fatalf("Conditions weren't parsed: %v\n", playbook.Tasks)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// CopyModule uploads a local file, or inline content, to a host. The file is
+// only replaced when its checksum differs, so copying the same file again
+// reports ok rather than changed. e.g.
+//
+//	tasks:
+//	  - name: nginx config
+//	    copy:
+//	      src: files/nginx.conf
+//	      dest: /etc/nginx/nginx.conf
+//	      mode: "0644"
+//	      owner: root
+//	      backup: true
+type CopyModule struct {
+	// Local file to copy, relative to the playbook's directory
+	Src string `yaml:"src,omitempty"`
+	// Copied instead of src when it's set
+	Content *string `yaml:"content,omitempty"`
+	// Remote path to copy to. When it's a directory, or ends in a /, src is
+	// copied into it under its own name
+	Dest string `yaml:"dest"`
+	// Permissions for dest, in octal or symbolic form as chmod takes them. A
+	// replaced file keeps its permissions unless these are set
+	Mode  string `yaml:"mode,omitempty"`
+	Owner string `yaml:"owner,omitempty"`
+	Group string `yaml:"group,omitempty"`
+	// Keep the previous version of dest next to it, suffixed with the time
+	// it was replaced
+	Backup bool `yaml:"backup,omitempty"`
+}
+
+func (c CopyModule) validate() error {
+	if c.Src == "" && c.Content == nil {
+		return errors.New("copy needs src or content")
+	}
+	if c.Src != "" && c.Content != nil {
+		return errors.New("copy takes only one of src and content")
+	}
+	if c.Dest == "" {
+		return errors.New("copy needs a dest")
+	}
+	return nil
+}
+
+func (c CopyModule) install() fileInstall {
+	return fileInstall{
+		attrs:  fileAttributes{Mode: c.Mode, Owner: c.Owner, Group: c.Group},
+		backup: c.Backup,
+	}
+}
+
+// runCopy runs a copy task, baseDir is the directory relative srcs are in
+func runCopy(module CopyModule, baseDir string, conn Connection, options RunOptions) TaskResult {
+	start := time.Now()
+	if err := module.validate(); err != nil {
+		return fileTaskError(err, start)
+	}
+	var content []byte
+	if module.Content != nil {
+		content = []byte(*module.Content)
+	} else {
+		src, err := localPath(baseDir, module.Src)
+		if err != nil {
+			return fileTaskError(err, start)
+		}
+		if info, err := os.Stat(src); err == nil && info.IsDir() {
+			return fileTaskError(fmt.Errorf("copy src %v is a directory", module.Src), start)
+		}
+		if content, err = os.ReadFile(src); err != nil {
+			return fileTaskError(err, start)
+		}
+	}
+	return installFile(content, module.Src, module.Dest, module.install(), conn, options, start)
+}
+
+// installFile puts content at dest unless it's already there, and applies its
+// attributes either way. src names the content for a dest which is a directory
+func installFile(content []byte, src, dest string, install fileInstall, conn Connection, options RunOptions, start time.Time) TaskResult {
+	if strings.HasSuffix(dest, "/") {
+		if src == "" {
+			return fileTaskError(fmt.Errorf("dest %v is a directory", dest), start)
+		}
+		dest = path.Join(dest, filepath.Base(src))
+	}
+	existing, err := probeRemoteFile(conn, dest, options)
+	if err != nil {
+		return fileTaskError(err, start)
+	}
+	if existing.isDir {
+		if src == "" {
+			return fileTaskError(fmt.Errorf("dest %v is a directory", dest), start)
+		}
+		dest = path.Join(dest, filepath.Base(src))
+		if existing, err = probeRemoteFile(conn, dest, options); err != nil {
+			return fileTaskError(err, start)
+		}
+		if existing.isDir {
+			return fileTaskError(fmt.Errorf("dest %v is a directory", dest), start)
+		}
+	}
+
+	sum := checksum(content)
+	result := fileResult{
+		details: map[string]interface{}{
+			"dest":     dest,
+			"checksum": sum,
+		},
+		start: start,
+	}
+	if existing.exists && existing.checksum == sum {
+		changed, err := setRemoteAttributes(conn, dest, install.attrs, options)
+		if err != nil {
+			return fileTaskError(err, start)
+		}
+		result.changed = changed
+		result.msg = fmt.Sprintf("%v is up to date", dest)
+		if changed {
+			result.msg = fmt.Sprintf("%v permissions changed", dest)
+		}
+		result.end = time.Now()
+		return result
+	}
+
+	backupFile, err := installRemoteFile(conn, content, dest, install, options)
+	if err != nil {
+		return fileTaskError(err, start)
+	}
+	result.changed = true
+	result.msg = fmt.Sprintf("%v updated", dest)
+	if backupFile != "" {
+		result.details["backup_file"] = backupFile
+		result.msg += fmt.Sprintf(", previous version backed up to %v", backupFile)
+	}
+	result.end = time.Now()
+	return result
+}
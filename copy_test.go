@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestCopyValidate(t *testing.T) {
+	for _, task := range []string{
+		"copy: {content: hello}",
+		"copy: {dest: /tmp/hello}",
+		"copy: {src: hello, content: hello, dest: /tmp/hello}",
+		"{cmd: echo hello, copy: {content: hello, dest: /tmp/hello}}",
+	} {
+		_, err := playbookFromContents([]byte("hosts: [all]\ntasks:\n  - " + task + "\n"))
+		if err == nil {
+			t.Fatalf("Expected an error for task %v\n", task)
+		}
+	}
+	playbook, err := playbookFromContents([]byte("hosts: [all]\ntasks:\n  - copy: {content: hello, dest: /tmp/hello, mode: 0640}\n"))
+	if err != nil {
+		t.Fatalf("Unexpected error reading copy task: %v\n", err)
+	}
+	if module := playbook.Tasks[0].Copy; module == nil || *module.Content != "hello" || module.Mode != "0640" {
+		t.Fatalf("Copy task wasn't read correctly, got %+v\n", module)
+	}
+}
+
+func TestSSHCopy(t *testing.T) {
+	conn := connectToTestServer(t)
+	dir := t.TempDir()
+	dest := filepath.Join(dir, "app.conf")
+	content := "listen 80\n"
+	module := CopyModule{Content: &content, Dest: dest, Mode: "0640"}
+
+	result := runCopy(module, "", conn, RunOptions{})
+	if result.Error() != nil || !result.Changed() {
+		t.Fatalf("Expected a new file to be changed, got %v %v\n", result.Changed(), result.Error())
+	}
+	assertFile(t, dest, content, 0640)
+	registered := registeredResult(result)
+	if registered["dest"] != dest || registered["checksum"] != checksum([]byte(content)) {
+		t.Fatalf("Expected dest and checksum to be registered, got %v\n", registered)
+	}
+
+	result = runCopy(module, "", conn, RunOptions{})
+	if result.Error() != nil || result.Changed() {
+		t.Fatalf("Expected copying the same content to be ok, got %v %v\n", result.Changed(), result.Error())
+	}
+
+	module.Mode = "0600"
+	result = runCopy(module, "", conn, RunOptions{})
+	if result.Error() != nil || !result.Changed() {
+		t.Fatalf("Expected a mode change to be changed, got %v %v\n", result.Changed(), result.Error())
+	}
+	assertFile(t, dest, content, 0600)
+
+	// A replaced file keeps its mode, and the old version is backed up
+	updated := "listen 8080\n"
+	result = runCopy(CopyModule{Content: &updated, Dest: dest, Backup: true}, "", conn, RunOptions{})
+	if result.Error() != nil || !result.Changed() {
+		t.Fatalf("Expected new content to be changed, got %v %v\n", result.Changed(), result.Error())
+	}
+	assertFile(t, dest, updated, 0600)
+	backupFile, _ := registeredResult(result)["backup_file"].(string)
+	if !strings.HasPrefix(backupFile, dest+".") {
+		t.Fatalf("Expected a backup file, got %q\n", backupFile)
+	}
+	assertFile(t, backupFile, content, 0600)
+
+	// A src is relative to the playbook and copied into a directory dest
+	local := t.TempDir()
+	if err := os.WriteFile(filepath.Join(local, "motd"), []byte("welcome\n"), 0644); err != nil {
+		t.Fatalf("Unable to write local file: %v\n", err)
+	}
+	result = runCopy(CopyModule{Src: "motd", Dest: dir}, local, conn, RunOptions{})
+	if result.Error() != nil || !result.Changed() {
+		t.Fatalf("Expected src to be copied, got %v %v\n", result.Changed(), result.Error())
+	}
+	reference := filepath.Join(t.TempDir(), "reference")
+	if err := os.WriteFile(reference, nil, 0666); err != nil {
+		t.Fatalf("Unable to write reference file: %v\n", err)
+	}
+	defaultMode, _ := os.Stat(reference)
+	assertFile(t, filepath.Join(dir, "motd"), "welcome\n", defaultMode.Mode().Perm())
+
+	result = runCopy(CopyModule{Src: "missing", Dest: dir}, local, conn, RunOptions{})
+	if result.Error() == nil || result.FailureCategory() != CommandFailure {
+		t.Fatalf("Expected a missing src to fail, got %v\n", result.Error())
+	}
+
+	entries, _ := os.ReadDir(dir)
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".goat-tmp-") {
+			t.Fatalf("Temporary file %v was left behind\n", entry.Name())
+		}
+	}
+}
+
+func TestSSHCopyBecome(t *testing.T) {
+	installFakeBecome(t)
+	conn := connectToTestServer(t)
+	dest := filepath.Join(t.TempDir(), "app.conf")
+	content := "listen 80\n"
+	options := RunOptions{Become: &Become{User: "root", Method: SudoBecome, Password: "correct"}}
+	staged, _ := filepath.Glob("/tmp/.goat-stage-*")
+
+	result := runCopy(CopyModule{Content: &content, Dest: dest, Mode: "0644"}, "", conn, options)
+	if result.Error() != nil || !result.Changed() {
+		t.Fatalf("Expected the file to be copied with become, got %v %v\n", result.Changed(), result.Error())
+	}
+	assertFile(t, dest, content, 0644)
+	if after, _ := filepath.Glob("/tmp/.goat-stage-*"); len(after) != len(staged) {
+		t.Fatalf("Expected the staged file to be removed, found %v\n", after)
+	}
+
+	options.Become.Password = "wrong"
+	result = runCopy(CopyModule{Content: &content, Dest: dest}, "", conn, options)
+	if result.Error() == nil || result.FailureCategory() != AuthFailure {
+		t.Fatalf("Expected a wrong become_password to fail, got %v\n", result.Error())
+	}
+	if after, _ := filepath.Glob("/tmp/.goat-stage-*"); len(after) != len(staged) {
+		t.Fatalf("Expected the staged file to be removed when become fails, found %v\n", after)
+	}
+}
+
+func TestUploadStagePrivate(t *testing.T) {
+	conn := connectToTestServer(t)
+	nobody, err := user.Lookup("nobody")
+	if err != nil {
+		t.Skipf("No nobody user to become: %v\n", err)
+	}
+	stage := newUploadStage(conn, RunOptions{Become: &Become{User: "nobody", Method: SudoBecome}})
+	staged, err := stage.upload(strings.NewReader("secret\n"), t.TempDir(), 0600)
+	if err != nil {
+		t.Fatalf("Unexpected error uploading: %v\n", err)
+	}
+	if !strings.HasPrefix(staged, "/tmp/.goat-stage-") {
+		t.Fatalf("Expected a file for a become user to be staged in /tmp, got %v\n", staged)
+	}
+	dirInfo, _ := os.Stat(filepath.Dir(staged))
+	if dirInfo.Mode().Perm() != 0700 {
+		t.Fatalf("Expected the staging directory to be private, got %v\n", dirInfo.Mode().Perm())
+	}
+	assertFile(t, staged, "secret\n", 0600)
+
+	if err := stage.share(); err != nil {
+		t.Fatalf("Unexpected error sharing with the become user: %v\n", err)
+	}
+	info, _ := os.Stat(staged)
+	if acl, _ := exec.Command("getfacl", "-p", staged).Output(); !strings.Contains(string(acl), "user:nobody:r") {
+		if uid := fmt.Sprint(info.Sys().(*syscall.Stat_t).Uid); uid != nobody.Uid {
+			t.Fatalf("Expected the become user to be given access, owner is %v\n", uid)
+		}
+	}
+	if info.Mode().Perm()&0007 != 0 {
+		t.Fatalf("Expected the staged file not to be readable by everyone, got %v\n", info.Mode().Perm())
+	}
+
+	stage.remove()
+	if _, err := os.Stat(filepath.Dir(staged)); err == nil {
+		t.Fatalf("Expected the staging directory to be removed\n")
+	}
+}
+
+func assertFile(t *testing.T, file, content string, mode os.FileMode) {
+	t.Helper()
+	contents, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatalf("Unable to read %v: %v\n", file, err)
+	}
+	if string(contents) != content {
+		t.Fatalf("Expected %v to contain %q, got %q\n", file, content, contents)
+	}
+	info, _ := os.Stat(file)
+	if info.Mode().Perm() != mode {
+		t.Fatalf("Expected %v to have mode %v, got %v\n", file, mode, info.Mode().Perm())
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// FetchModule downloads files from a host. Each file is saved under a
+// directory named after the host, dest/<host>/<remote path>, so fetching the
+// same file from many hosts doesn't overwrite it. A file which is already
+// there with the same checksum isn't downloaded again. e.g.
+//
+//	tasks:
+//	  - name: collect logs
+//	    fetch:
+//	      src: /var/log/app/*.log
+//	      dest: logs
+type FetchModule struct {
+	// Remote file to fetch, or a glob expanded by the host's shell
+	Src string `yaml:"src"`
+	// Local directory to fetch into, relative to the playbook's directory
+	Dest string `yaml:"dest"`
+	// Save the file as dest itself instead of under the host's directory.
+	// When dest ends in a / or src is a glob, files are saved in dest under
+	// their own names
+	Flat bool `yaml:"flat,omitempty"`
+	// Whether a src which doesn't exist fails the task, when false the task
+	// is skipped instead. Defaults to true
+	FailOnMissing *bool `yaml:"fail_on_missing,omitempty"`
+}
+
+// fetchedFile is a remote file matched by a fetch's src
+type fetchedFile struct {
+	path     string
+	checksum string
+}
+
+func (f FetchModule) validate() error {
+	if f.Src == "" {
+		return errors.New("fetch needs a src")
+	}
+	if f.Dest == "" {
+		return errors.New("fetch needs a dest")
+	}
+	return nil
+}
+
+func (f FetchModule) isGlob() bool {
+	return strings.ContainsAny(f.Src, "*?[")
+}
+
+// localDest is where a remote file is saved, under dest. Remote paths with
+// .. in them are rejected, they could be saved outside of dest
+func (f FetchModule) localDest(dest, hostname, remotePath string) (string, error) {
+	for _, element := range strings.Split(remotePath, "/") {
+		if element == ".." {
+			return "", fmt.Errorf("Refusing to fetch %v, its path contains ..", remotePath)
+		}
+	}
+	if !f.Flat {
+		return filepath.Join(dest, hostname, filepath.FromSlash(remotePath)), nil
+	}
+	if f.isGlob() || strings.HasSuffix(f.Dest, "/") {
+		return filepath.Join(dest, path.Base(remotePath)), nil
+	}
+	return dest, nil
+}
+
+// runFetch runs a fetch task on hostname, baseDir is the directory a
+// relative dest is in
+func runFetch(module FetchModule, baseDir, hostname string, conn Connection, options RunOptions) TaskResult {
+	start := time.Now()
+	if err := module.validate(); err != nil {
+		return fileTaskError(err, start)
+	}
+	dest, err := localPath(baseDir, module.Dest)
+	if err != nil {
+		return fileTaskError(err, start)
+	}
+	matches, err := module.remoteFiles(conn, options)
+	if err != nil {
+		return fileTaskError(err, start)
+	}
+	if len(matches) <= 0 {
+		err := fmt.Errorf("src %v not found", module.Src)
+		if module.FailOnMissing == nil || *module.FailOnMissing {
+			return fileTaskError(err, start)
+		}
+		return fileResult{skipped: true, msg: err.Error(), start: start, end: time.Now()}
+	}
+
+	result := fileResult{start: start}
+	files := make([]interface{}, 0, len(matches))
+	messages := make([]string, 0, len(matches))
+	for _, match := range matches {
+		local, err := module.localDest(dest, hostname, match.path)
+		if err != nil {
+			return fileTaskError(err, start)
+		}
+		changed, err := fetchFile(conn, match, local, options)
+		if err != nil {
+			return fileTaskError(err, start)
+		}
+		result.changed = result.changed || changed
+		files = append(files, map[string]interface{}{
+			"src":      match.path,
+			"dest":     local,
+			"checksum": match.checksum,
+			"changed":  changed,
+		})
+		if changed {
+			messages = append(messages, fmt.Sprintf("fetched %v to %v", match.path, local))
+		} else {
+			messages = append(messages, fmt.Sprintf("%v is up to date", local))
+		}
+	}
+	result.msg = strings.Join(messages, "\n")
+	result.details = map[string]interface{}{"files": files}
+	if !module.isGlob() {
+		result.details["dest"] = files[0].(map[string]interface{})["dest"]
+		result.details["checksum"] = matches[0].checksum
+	}
+	result.end = time.Now()
+	return result
+}
+
+// remoteFiles checksums the files src matches on the host
+func (f FetchModule) remoteFiles(conn Connection, options RunOptions) ([]fetchedFile, error) {
+	if !f.isGlob() {
+		existing, err := probeRemoteFile(conn, f.Src, options)
+		if err != nil {
+			return nil, err
+		}
+		if existing.isDir {
+			return nil, fmt.Errorf("src %v is a directory", f.Src)
+		}
+		if !existing.exists {
+			return nil, nil
+		}
+		return []fetchedFile{{path: f.Src, checksum: existing.checksum}}, nil
+	}
+	// The pattern is expanded from a variable, which is never split or run
+	// as anything other than a glob
+	script := fmt.Sprintf(`pattern=%v; IFS=; for p in $pattern; do if [ -f "$p" ]; then sha256sum -- "$p"; fi; done`,
+		quoteFilter(f.Src))
+	output, err := runRemote(conn, script, options)
+	if err != nil {
+		return nil, err
+	}
+	matches := make([]fetchedFile, 0)
+	for _, line := range outputLines(output) {
+		sum, remotePath, found := strings.Cut(line.(string), "  ")
+		if !found {
+			return nil, fmt.Errorf("Unable to checksum %v", line)
+		}
+		matches = append(matches, fetchedFile{path: remotePath, checksum: sum})
+	}
+	return matches, nil
+}
+
+// fetchFile downloads a remote file to local unless it's already there,
+// returning whether it was downloaded
+func fetchFile(conn Connection, remote fetchedFile, local string, options RunOptions) (bool, error) {
+	if existing, err := os.ReadFile(local); err == nil && checksum(existing) == remote.checksum {
+		return false, nil
+	}
+	content, err := downloadRemoteFile(conn, remote.path, options)
+	if err != nil {
+		return false, fmt.Errorf("Unable to fetch %v: %v", remote.path, err)
+	}
+	if checksum(content) != remote.checksum {
+		return false, fmt.Errorf("Checksum mismatch fetching %v, it may have changed during the fetch", remote.path)
+	}
+	if err := writeLocalFile(local, content); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// downloadRemoteFile reads a file on the host, as the become user when there
+// is one
+func downloadRemoteFile(conn Connection, remotePath string, options RunOptions) ([]byte, error) {
+	if options.Become != nil {
+		output, err := runRemote(conn, fmt.Sprintf("base64 -- %v", quoteFilter(remotePath)), options)
+		if err != nil {
+			return nil, err
+		}
+		return base64.StdEncoding.DecodeString(strings.Join(strings.Fields(output), ""))
+	}
+	transfer, ok := conn.(FileTransfer)
+	if !ok {
+		return nil, errors.New("The connection doesn't support file transfers")
+	}
+	var content bytes.Buffer
+	if err := transfer.Download(remotePath, &content); err != nil {
+		return nil, err
+	}
+	return content.Bytes(), nil
+}
+
+// writeLocalFile atomically replaces a local file, creating its directory.
+// Fetched files may be private, such as keys, so only the user can read them
+func writeLocalFile(file string, content []byte) error {
+	dir := filepath.Dir(file)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, ".goat-tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFetchLocalDest(t *testing.T) {
+	cases := []struct {
+		module   FetchModule
+		expected string
+	}{
+		{FetchModule{Src: "/var/log/app.log", Dest: "logs"}, "logs/web1/var/log/app.log"},
+		{FetchModule{Src: "/var/log/app.log", Dest: "logs/app.log", Flat: true}, "logs/app.log"},
+		{FetchModule{Src: "/var/log/app.log", Dest: "logs/", Flat: true}, "logs/app.log"},
+		{FetchModule{Src: "/var/log/*.log", Dest: "logs", Flat: true}, "logs/app.log"},
+	}
+	for _, c := range cases {
+		dest, err := c.module.localDest(filepath.Clean(c.module.Dest), "web1", "/var/log/app.log")
+		if err != nil || dest != c.expected {
+			t.Fatalf("Expected %+v to fetch to %v, got %v %v\n", c.module, c.expected, dest, err)
+		}
+	}
+	for _, remotePath := range []string{"/a/../../../x", "../../x", "logs/.."} {
+		for _, flat := range []bool{false, true} {
+			module := FetchModule{Src: remotePath, Dest: "logs/", Flat: flat}
+			if dest, err := module.localDest("logs", "web1", remotePath); err == nil {
+				t.Fatalf("Expected %v to be rejected, got %v\n", remotePath, dest)
+			}
+		}
+	}
+}
+
+func TestSSHFetch(t *testing.T) {
+	conn := connectToTestServer(t)
+	remote := t.TempDir()
+	for name, content := range map[string]string{"a.log": "first\n", "b.log": "second\n", "c.txt": "third\n"} {
+		if err := os.WriteFile(filepath.Join(remote, name), []byte(content), 0644); err != nil {
+			t.Fatalf("Unable to write remote file: %v\n", err)
+		}
+	}
+	local := t.TempDir()
+	src := filepath.Join(remote, "a.log")
+
+	result := runFetch(FetchModule{Src: src, Dest: "logs"}, local, "web1", conn, RunOptions{})
+	if result.Error() != nil || !result.Changed() {
+		t.Fatalf("Expected the file to be fetched, got %v %v\n", result.Changed(), result.Error())
+	}
+	fetched := filepath.Join(local, "logs", "web1", src)
+	assertFile(t, fetched, "first\n", 0600)
+	if registered := registeredResult(result); registered["dest"] != fetched || registered["checksum"] != checksum([]byte("first\n")) {
+		t.Fatalf("Expected dest and checksum to be registered, got %v\n", registered)
+	}
+
+	result = runFetch(FetchModule{Src: src, Dest: "logs"}, local, "web1", conn, RunOptions{})
+	if result.Error() != nil || result.Changed() {
+		t.Fatalf("Expected fetching an unchanged file to be ok, got %v %v\n", result.Changed(), result.Error())
+	}
+
+	result = runFetch(FetchModule{Src: filepath.Join(remote, "*.log"), Dest: "flat", Flat: true}, local, "web1", conn, RunOptions{})
+	if result.Error() != nil || !result.Changed() {
+		t.Fatalf("Expected the glob to be fetched, got %v %v\n", result.Changed(), result.Error())
+	}
+	assertFile(t, filepath.Join(local, "flat", "a.log"), "first\n", 0600)
+	assertFile(t, filepath.Join(local, "flat", "b.log"), "second\n", 0600)
+	if _, err := os.Stat(filepath.Join(local, "flat", "c.txt")); err == nil {
+		t.Fatalf("Expected only files matching the glob to be fetched\n")
+	}
+	if files := registeredResult(result)["files"].([]interface{}); len(files) != 2 {
+		t.Fatalf("Expected both files to be registered, got %v\n", files)
+	}
+
+	// Globs may contain spaces and are never run as shell
+	spaced := filepath.Join(remote, "with space")
+	writeTree(t, spaced, map[string]string{"d.log": "fourth\n"})
+	result = runFetch(FetchModule{Src: filepath.Join(spaced, "*.log"), Dest: "spaced/", Flat: true}, local, "web1", conn, RunOptions{})
+	if result.Error() != nil || !result.Changed() {
+		t.Fatalf("Expected a glob with a space to be fetched, got %v %v\n", result.Changed(), result.Error())
+	}
+	assertFile(t, filepath.Join(local, "spaced", "d.log"), "fourth\n", 0600)
+	injected := filepath.Join(remote, "injected")
+	result = runFetch(FetchModule{Src: remote + "/*$(touch " + injected + ")", Dest: "logs"}, local, "web1", conn, RunOptions{})
+	if _, err := os.Stat(injected); err == nil {
+		t.Fatalf("A glob shouldn't be able to run commands\n")
+	}
+
+	missing := filepath.Join(remote, "missing.log")
+	result = runFetch(FetchModule{Src: missing, Dest: "logs"}, local, "web1", conn, RunOptions{})
+	if result.Error() == nil {
+		t.Fatalf("Expected a missing file to fail\n")
+	}
+	no := false
+	result = runFetch(FetchModule{Src: missing, Dest: "logs", FailOnMissing: &no}, local, "web1", conn, RunOptions{})
+	if result.Error() != nil || !result.Skipped() {
+		t.Fatalf("Expected a missing file to be skipped, got %v %v\n", result.Skipped(), result.Error())
+	}
+	result = runFetch(FetchModule{Src: filepath.Join(remote, "*.gz"), Dest: "logs", FailOnMissing: &no}, local, "web1", conn, RunOptions{})
+	if result.Error() != nil || !result.Skipped() {
+		t.Fatalf("Expected a glob matching nothing to be skipped, got %v %v\n", result.Skipped(), result.Error())
+	}
+}
+
+func TestSSHFetchBecome(t *testing.T) {
+	installFakeBecome(t)
+	conn := connectToTestServer(t)
+	src := filepath.Join(t.TempDir(), "secret.pem")
+	if err := os.WriteFile(src, []byte{0, 1, 2, 255}, 0600); err != nil {
+		t.Fatalf("Unable to write remote file: %v\n", err)
+	}
+	dest := filepath.Join(t.TempDir(), "secret.pem")
+	options := RunOptions{Become: &Become{User: "root", Method: SudoBecome, Password: "correct"}}
+
+	result := runFetch(FetchModule{Src: src, Dest: dest, Flat: true}, "", "web1", conn, options)
+	if result.Error() != nil || !result.Changed() {
+		t.Fatalf("Expected the file to be fetched with become, got %v %v\n", result.Changed(), result.Error())
+	}
+	assertFile(t, dest, string([]byte{0, 1, 2, 255}), 0600)
+}
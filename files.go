@@ -0,0 +1,396 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// The file tasks (copy and those built on it, fetch, synchronize) move file
+// contents over SFTP and do everything else, checksums, permissions, backups
+// and the final rename into place, with small shell commands. The commands
+// run like any other task's, so they work with become: the file is uploaded
+// as the connecting user to a private directory in /tmp (see uploadStage),
+// then copied next to its destination as the become user before being
+// renamed over it. Without become it's uploaded straight to a temporary file
+// next to its destination.
+// Files fetched with become are read by the become user and sent back base64
+// encoded, since the connecting user may not be able to read them.
+//
+// Remote hosts are expected to have a POSIX shell and GNU coreutils and
+// findutils.
+
+// FileTransfer is implemented by connections which can copy files to a host,
+// the file tasks need it
+type FileTransfer interface {
+	// Upload writes content to path on the host, creating or truncating it
+	// with mode
+	Upload(content io.Reader, path string, mode os.FileMode) error
+	// Download writes the contents of path on the host to content
+	Download(path string, content io.Writer) error
+}
+
+// fileAttributes are the permissions a file task sets, empty values leave
+// the file's current ones
+type fileAttributes struct {
+	Mode  string
+	Owner string
+	Group string
+}
+
+// fileInstall is how a file task puts a new version of a file in place
+type fileInstall struct {
+	attrs fileAttributes
+	// Keep the previous version next to the file, suffixed with the time it
+	// was replaced
+	backup bool
+	// Command which checks the new version before it replaces the file,
+	// with %s standing in for its path
+	validate string
+}
+
+// remoteFile is the state of a path on the host before a file task changes it
+type remoteFile struct {
+	exists   bool
+	isDir    bool
+	checksum string
+}
+
+// fileResult is the result of a file task
+type fileResult struct {
+	err      error
+	category int
+	changed  bool
+	skipped  bool
+	msg      string
+	details  map[string]interface{}
+	start    time.Time
+	end      time.Time
+}
+
+func (f fileResult) StdoutBytes() []byte {
+	return []byte(f.Stdout())
+}
+
+func (f fileResult) StderrBytes() []byte {
+	return []byte{}
+}
+
+func (f fileResult) Stdout() string {
+	if f.msg == "" {
+		return ""
+	}
+	return f.msg + "\n"
+}
+
+func (f fileResult) Stderr() string {
+	return ""
+}
+
+func (f fileResult) Error() error {
+	return f.err
+}
+
+func (f fileResult) Skipped() bool {
+	return f.skipped
+}
+
+func (f fileResult) ExitCode() int {
+	if f.err != nil {
+		return -1
+	}
+	return 0
+}
+
+func (f fileResult) Signal() string {
+	return ""
+}
+
+func (f fileResult) FailureCategory() int {
+	return f.category
+}
+
+func (f fileResult) Changed() bool {
+	return f.err == nil && f.changed
+}
+
+func (f fileResult) Failed() bool {
+	return f.err != nil
+}
+
+func (f fileResult) Start() time.Time {
+	return f.start
+}
+
+func (f fileResult) End() time.Time {
+	return f.end
+}
+
+// Details are registered along with the usual results, see registeredResult
+func (f fileResult) Details() map[string]interface{} {
+	return f.details
+}
+
+// fileTaskError is the failed result of a file task. A command which failed
+// to reach the host keeps its own category
+func fileTaskError(err error, start time.Time) fileResult {
+	category := CommandFailure
+	var commandErr *remoteCommandError
+	if errors.As(err, &commandErr) {
+		category = commandErr.category
+	}
+	return fileResult{err: err, category: category, start: start, end: time.Now()}
+}
+
+// remoteCommandError is returned when one of a file task's commands fails
+type remoteCommandError struct {
+	category int
+	Err      error
+}
+
+func (r *remoteCommandError) Error() string {
+	return r.Err.Error()
+}
+
+// runRemote runs one of a file task's commands, returning its stdout
+func runRemote(conn Connection, script string, options RunOptions) (string, error) {
+	result := conn.Run(script, options)
+	if err := result.Error(); err != nil {
+		stderr := strings.TrimSpace(result.Stderr())
+		if stderr != "" {
+			err = fmt.Errorf("%v: %v", err, stderr)
+		}
+		return "", &remoteCommandError{category: result.FailureCategory(), Err: err}
+	}
+	return result.Stdout(), nil
+}
+
+// probeRemoteFile checksums a file on the host
+func probeRemoteFile(conn Connection, remotePath string, options RunOptions) (remoteFile, error) {
+	script := fmt.Sprintf(`p=%v; if [ -d "$p" ]; then echo directory; `+
+		`elif [ -e "$p" ]; then sha256sum -- "$p"; else echo missing; fi`, quoteFilter(remotePath))
+	output, err := runRemote(conn, script, options)
+	if err != nil {
+		return remoteFile{}, err
+	}
+	fields := strings.Fields(output)
+	switch {
+	case len(fields) <= 0:
+		return remoteFile{}, fmt.Errorf("Unable to checksum %v", remotePath)
+	case fields[0] == "directory":
+		return remoteFile{exists: true, isDir: true}, nil
+	case fields[0] == "missing":
+		return remoteFile{}, nil
+	}
+	return remoteFile{exists: true, checksum: fields[0]}, nil
+}
+
+// installRemoteFile atomically replaces dest with content, returning the path
+// the previous version was backed up to when there was one to back up. dest is
+// left as it was when the validate command fails
+func installRemoteFile(conn Connection, content []byte, dest string, install fileInstall, options RunOptions) (string, error) {
+	stage := newUploadStage(conn, options)
+	staged, err := stage.upload(bytes.NewReader(content), path.Dir(dest), 0600)
+	if err == nil {
+		err = stage.share()
+	}
+	if err != nil {
+		stage.remove()
+		return "", fmt.Errorf("Unable to upload %v: %v", dest, err)
+	}
+
+	backupFile := ""
+	if install.backup {
+		backupFile = dest + "." + time.Now().Format("2006-01-02@15:04:05") + "~"
+	}
+	var script strings.Builder
+	script.WriteString("set -e\n")
+	script.WriteString(fmt.Sprintf("dest=%v\nstaged=%v\n", quoteFilter(dest), quoteFilter(staged)))
+	if options.Become != nil {
+		script.WriteString(`trap 'rm -f -- "$tmp"' EXIT` + "\n")
+		script.WriteString(`tmp=$(mktemp -- "$(dirname -- "$dest")/.goat-tmp-XXXXXX")` + "\n")
+		script.WriteString(`cat -- "$staged" > "$tmp"` + "\n")
+	} else {
+		script.WriteString(`tmp=$staged` + "\n")
+		script.WriteString(`trap 'rm -f -- "$tmp"' EXIT` + "\n")
+	}
+	// A replaced file keeps its permissions, a new one gets the default
+	script.WriteString(`if [ -e "$dest" ]; then` + "\n")
+	script.WriteString(`chmod "$(stat -c %a -- "$dest")" "$tmp"` + "\n")
+	script.WriteString(`chown "$(stat -c %u:%g -- "$dest")" "$tmp" 2>/dev/null || true` + "\n")
+	script.WriteString("else\n")
+	script.WriteString(`chmod "$(printf '%o' $((0666 & ~0$(umask))))" "$tmp"` + "\n")
+	script.WriteString("fi\n")
+	script.WriteString(attributeCommands(`"$tmp"`, install.attrs))
+	if install.validate != "" {
+		validate := strings.ReplaceAll(install.validate, "%s", `"$tmp"`)
+		script.WriteString(fmt.Sprintf("if ! { %v\n} >&2; then\n", validate))
+		script.WriteString(fmt.Sprintf("echo %v >&2\nexit 1\nfi\n", quoteFilter("Validation failed: "+install.validate)))
+	}
+	if install.backup {
+		script.WriteString(`if [ -e "$dest" ]; then` + "\n")
+		script.WriteString(fmt.Sprintf(`cp -p -- "$dest" %v`+"\n", quoteFilter(backupFile)))
+		script.WriteString("echo backup\nfi\n")
+	}
+	script.WriteString(`mv -f -- "$tmp" "$dest"` + "\n")
+
+	output, err := runRemote(conn, script.String(), options)
+	if err != nil || options.Become != nil {
+		// The script's trap can't have run if it failed to start, and a
+		// become user can't remove the private directory
+		stage.remove()
+	}
+	if err != nil {
+		return "", err
+	}
+	if strings.TrimSpace(output) != "backup" {
+		backupFile = ""
+	}
+	return backupFile, nil
+}
+
+// uploadStage is where a file task uploads files before installing them.
+// Files installed by the connecting user are uploaded next to where they're
+// going, so they can be renamed into place. Those installed by a become user
+// are uploaded to a private directory in /tmp, which only the become user is
+// then given access to
+type uploadStage struct {
+	conn    Connection
+	options RunOptions
+	// The private directory, once it's been created
+	dir string
+	// Files uploaded outside the private directory
+	files []string
+}
+
+func newUploadStage(conn Connection, options RunOptions) *uploadStage {
+	return &uploadStage{conn: conn, options: options}
+}
+
+// upload uploads content to a new file, returning its path. The file is in
+// nextTo unless the file is for a become user or nextTo is empty
+func (u *uploadStage) upload(content io.Reader, nextTo string, mode os.FileMode) (string, error) {
+	transfer, ok := u.conn.(FileTransfer)
+	if !ok {
+		return "", errors.New("The connection doesn't support file transfers")
+	}
+	staged := path.Join(nextTo, ".goat-tmp-"+randomSuffix())
+	if u.options.Become != nil || nextTo == "" {
+		if u.dir == "" {
+			output, err := runRemote(u.conn, "mktemp -d /tmp/.goat-stage-XXXXXX", RunOptions{})
+			if err != nil {
+				return "", err
+			}
+			u.dir = strings.TrimSpace(output)
+		}
+		staged = path.Join(u.dir, randomSuffix())
+	} else {
+		u.files = append(u.files, staged)
+	}
+	if err := transfer.Upload(content, staged, mode); err != nil {
+		return "", err
+	}
+	return staged, nil
+}
+
+// share gives the become user access to the private directory, once every
+// file has been uploaded. Root needs no help, anyone else is given access
+// with an ACL, or ownership when ACLs aren't supported
+func (u *uploadStage) share() error {
+	if u.dir == "" || u.options.Become == nil || u.options.Become.User == "root" {
+		return nil
+	}
+	user, dir := quoteFilter(u.options.Become.User), quoteFilter(u.dir)
+	script := fmt.Sprintf("setfacl -R -m u:%v:rX -- %v 2>/dev/null || chown -R %v -- %v", user, dir, user, dir)
+	if _, err := runRemote(u.conn, script, RunOptions{}); err != nil {
+		return fmt.Errorf("Unable to give become user %v access to uploaded files, setfacl is needed: %v",
+			u.options.Become.User, err)
+	}
+	return nil
+}
+
+// remove removes whatever is left of the uploaded files, as the connecting
+// user who uploaded them
+func (u *uploadStage) remove() {
+	staged := u.files
+	if u.dir != "" {
+		staged = append(staged, u.dir)
+	}
+	if len(staged) > 0 {
+		runRemote(u.conn, fmt.Sprintf("rm -rf -- %v", quotePaths(staged)), RunOptions{})
+	}
+}
+
+// setRemoteAttributes applies attrs to an existing file, returning whether
+// anything changed
+func setRemoteAttributes(conn Connection, remotePath string, attrs fileAttributes, options RunOptions) (bool, error) {
+	if attrs == (fileAttributes{}) {
+		return false, nil
+	}
+	script := fmt.Sprintf("set -e\np=%v\n", quoteFilter(remotePath)) +
+		`before=$(stat -c '%a %u %g' -- "$p")` + "\n" +
+		attributeCommands(`"$p"`, attrs) +
+		`after=$(stat -c '%a %u %g' -- "$p")` + "\n" +
+		`[ "$before" = "$after" ] || echo changed` + "\n"
+	output, err := runRemote(conn, script, options)
+	if err != nil {
+		return false, err
+	}
+	return strings.TrimSpace(output) == "changed", nil
+}
+
+// attributeCommands sets attrs on target, which is already quoted
+func attributeCommands(target string, attrs fileAttributes) string {
+	var commands strings.Builder
+	if attrs.Mode != "" {
+		commands.WriteString(fmt.Sprintf("chmod %v %v\n", quoteFilter(attrs.Mode), target))
+	}
+	switch {
+	case attrs.Owner != "" && attrs.Group != "":
+		commands.WriteString(fmt.Sprintf("chown %v %v\n", quoteFilter(attrs.Owner+":"+attrs.Group), target))
+	case attrs.Owner != "":
+		commands.WriteString(fmt.Sprintf("chown %v %v\n", quoteFilter(attrs.Owner), target))
+	case attrs.Group != "":
+		commands.WriteString(fmt.Sprintf("chgrp %v %v\n", quoteFilter(attrs.Group), target))
+	}
+	return commands.String()
+}
+
+// localPath resolves a task's local path, relative paths are relative to the
+// directory of the playbook file
+func localPath(baseDir, file string) (string, error) {
+	file, err := expandHome(file)
+	if err != nil {
+		return "", err
+	}
+	if filepath.IsAbs(file) || baseDir == "" {
+		return file, nil
+	}
+	return filepath.Join(baseDir, file), nil
+}
+
+// playbookDir is the directory of a playbook file, its relative paths are
+// relative to it
+func playbookDir(file string) string {
+	return filepath.Dir(file)
+}
+
+func checksum(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+func randomSuffix() string {
+	random := make([]byte, 8)
+	rand.Read(random)
+	return hex.EncodeToString(random)
+}
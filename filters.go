@@ -0,0 +1,282 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"hash"
+	"net"
+	"path"
+	"reflect"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+// templateFuncs is the single registry of functions available to templates,
+// whether they're in task strings, files or conditions. Every function takes
+// the value it operates on last, so each can be used as a filter at the end
+// of a pipeline, {{ .name | replace "-" "_" | upper }}
+func templateFuncs() template.FuncMap {
+	return template.FuncMap{
+		"default":       defaultValue,
+		"upper":         upperFilter,
+		"lower":         lowerFilter,
+		"replace":       replaceFilter,
+		"regex_replace": regexReplaceFilter,
+		"regex_search":  regexSearchFilter,
+		"split":         splitFilter,
+		"join":          joinFilter,
+		"to_json":       toJSONFilter,
+		"from_json":     fromJSONFilter,
+		"to_yaml":       toYAMLFilter,
+		"b64encode":     b64encodeFilter,
+		"b64decode":     b64decodeFilter,
+		"hash":          hashFilter,
+		"quote":         quoteFilter,
+		"basename":      basenameFilter,
+		"dirname":       dirnameFilter,
+		"ipaddr":        ipaddrFilter,
+		"bool":          boolFilter,
+	}
+}
+
+// defaultValue returns fallback when value is undefined or empty
+func defaultValue(fallback, value interface{}) interface{} {
+	if value == nil {
+		return fallback
+	}
+	if s, ok := value.(string); ok && s == "" {
+		return fallback
+	}
+	return value
+}
+
+// boolFilter interprets strings such as "yes", "on" and "1" as true, useful
+// for extra vars which are always strings
+func boolFilter(value interface{}) bool {
+	switch v := value.(type) {
+	case bool:
+		return v
+	case nil:
+		return false
+	}
+	switch strings.ToLower(strings.TrimSpace(toString(value))) {
+	case "true", "yes", "on", "y", "1":
+		return true
+	}
+	return false
+}
+
+func toString(value interface{}) string {
+	if value == nil {
+		return ""
+	}
+	if s, ok := value.(string); ok {
+		return s
+	}
+	return fmt.Sprint(value)
+}
+
+func upperFilter(value interface{}) string {
+	return strings.ToUpper(toString(value))
+}
+
+func lowerFilter(value interface{}) string {
+	return strings.ToLower(toString(value))
+}
+
+func replaceFilter(old, new string, value interface{}) string {
+	return strings.ReplaceAll(toString(value), old, new)
+}
+
+// regexReplaceFilter replaces every match of pattern, the replacement may
+// reference groups as $1 or ${name}
+func regexReplaceFilter(pattern, replacement string, value interface{}) (string, error) {
+	expression, err := regexp.Compile(pattern)
+	if err != nil {
+		return "", err
+	}
+	return expression.ReplaceAllString(toString(value), replacement), nil
+}
+
+// regexSearchFilter returns the first match of pattern, or an empty string
+func regexSearchFilter(pattern string, value interface{}) (string, error) {
+	expression, err := regexp.Compile(pattern)
+	if err != nil {
+		return "", err
+	}
+	return expression.FindString(toString(value)), nil
+}
+
+func splitFilter(separator string, value interface{}) []string {
+	return strings.Split(toString(value), separator)
+}
+
+func joinFilter(separator string, value interface{}) (string, error) {
+	list := reflect.ValueOf(value)
+	if value == nil {
+		return "", nil
+	}
+	if list.Kind() != reflect.Slice && list.Kind() != reflect.Array {
+		return "", fmt.Errorf("join expects a list, got %T", value)
+	}
+	parts := make([]string, list.Len())
+	for index := 0; index < list.Len(); index++ {
+		parts[index] = toString(list.Index(index).Interface())
+	}
+	return strings.Join(parts, separator), nil
+}
+
+func toJSONFilter(value interface{}) (string, error) {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	return string(encoded), nil
+}
+
+func fromJSONFilter(value interface{}) (interface{}, error) {
+	var decoded interface{}
+	if err := json.Unmarshal([]byte(toString(value)), &decoded); err != nil {
+		return nil, err
+	}
+	return decoded, nil
+}
+
+func toYAMLFilter(value interface{}) (string, error) {
+	encoded, err := yaml.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(string(encoded), "\n"), nil
+}
+
+func b64encodeFilter(value interface{}) string {
+	return base64.StdEncoding.EncodeToString([]byte(toString(value)))
+}
+
+func b64decodeFilter(value interface{}) (string, error) {
+	decoded, err := base64.StdEncoding.DecodeString(toString(value))
+	if err != nil {
+		return "", err
+	}
+	return string(decoded), nil
+}
+
+// hashFilter returns the hex digest of value, algorithm is one of md5, sha1,
+// sha256 or sha512
+func hashFilter(algorithm string, value interface{}) (string, error) {
+	var hasher hash.Hash
+	switch strings.ToLower(algorithm) {
+	case "md5":
+		hasher = md5.New()
+	case "sha1":
+		hasher = sha1.New()
+	case "sha256":
+		hasher = sha256.New()
+	case "sha512":
+		hasher = sha512.New()
+	default:
+		return "", fmt.Errorf("Unsupported hash algorithm: %v", algorithm)
+	}
+	hasher.Write([]byte(toString(value)))
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// quoteFilter single quotes value so the shell treats it as one literal word
+func quoteFilter(value interface{}) string {
+	return "'" + strings.ReplaceAll(toString(value), "'", `'"'"'`) + "'"
+}
+
+func basenameFilter(value interface{}) string {
+	return path.Base(toString(value))
+}
+
+func dirnameFilter(value interface{}) string {
+	return path.Dir(toString(value))
+}
+
+// ipaddrFilter validates and queries an IP address or CIDR. Called with only a
+// value it returns the value when it's a valid address or network, and an
+// empty string otherwise. An optional query, passed before the value, returns
+// part of it instead: address, network, netmask, prefix, broadcast, version,
+// or filters it: ipv4, ipv6, private, public
+func ipaddrFilter(args ...interface{}) (string, error) {
+	if len(args) < 1 || len(args) > 2 {
+		return "", fmt.Errorf("ipaddr expects an optional query and a value, got %v arguments", len(args))
+	}
+	query := ""
+	if len(args) == 2 {
+		query = toString(args[0])
+	}
+	value := strings.TrimSpace(toString(args[len(args)-1]))
+
+	ip, network, err := net.ParseCIDR(value)
+	if err != nil {
+		ip = net.ParseIP(value)
+		if ip == nil {
+			return "", nil
+		}
+		bits := 128
+		if ip.To4() != nil {
+			bits = 32
+		}
+		network = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	ones, _ := network.Mask.Size()
+
+	switch query {
+	case "":
+		return value, nil
+	case "address":
+		return ip.String(), nil
+	case "network":
+		return network.IP.String(), nil
+	case "netmask":
+		return net.IP(network.Mask).String(), nil
+	case "prefix":
+		return fmt.Sprint(ones), nil
+	case "broadcast":
+		broadcast := make(net.IP, len(network.IP))
+		for index := range network.IP {
+			broadcast[index] = network.IP[index] | ^network.Mask[index]
+		}
+		return broadcast.String(), nil
+	case "version":
+		if ip.To4() != nil {
+			return "4", nil
+		}
+		return "6", nil
+	case "ipv4":
+		if ip.To4() != nil {
+			return value, nil
+		}
+		return "", nil
+	case "ipv6":
+		if ip.To4() == nil {
+			return value, nil
+		}
+		return "", nil
+	case "private":
+		if ip.IsPrivate() {
+			return value, nil
+		}
+		return "", nil
+	case "public":
+		if !ip.IsPrivate() && !ip.IsLoopback() && !ip.IsLinkLocalUnicast() && !ip.IsUnspecified() {
+			return value, nil
+		}
+		return "", nil
+	}
+	return "", fmt.Errorf("Unknown ipaddr query: %v", query)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestTemplateFilters(t *testing.T) {
+	vars := map[string]interface{}{
+		"name":    "web-01",
+		"path":    "/etc/nginx/nginx.conf",
+		"csv":     "a,b,c",
+		"json":    `{"port": 8080}`,
+		"message": "it's here",
+		"cidr":    "192.168.1.10/24",
+	}
+	cases := map[string]interface{}{
+		`{{ .name | upper }}`:                                   "WEB-01",
+		`{{ "WEB" | lower }}`:                                   "web",
+		`{{ .name | replace "-" "_" }}`:                         "web_01",
+		`{{ .name | regex_replace "^(\\w+)-(\\d+)$" "$2-$1" }}`: "01-web",
+		`{{ .name | regex_search "\\d+" }}`:                     "01",
+		`{{ .csv | split "," | join " " }}`:                     "a b c",
+		`{{ (.json | from_json).port }}`:                        "8080",
+		`{{ .csv | split "," | to_json }}`:                      `["a","b","c"]`,
+		`{{ .csv | split "," | to_yaml }}`:                      "- a\n- b\n- c",
+		`{{ .name | b64encode }}`:                               "d2ViLTAx",
+		`{{ .name | b64encode | b64decode }}`:                   "web-01",
+		`{{ .name | hash "sha256" }}`:                           "0b9d9f06cc8cf44765a12c0aa01a6e2217130979f4dfeda24e22b0af7e8d237e",
+		`echo {{ .message | quote }}`:                           `echo 'it'"'"'s here'`,
+		`{{ .path | basename }}`:                                "nginx.conf",
+		`{{ .path | dirname }}`:                                 "/etc/nginx",
+		`{{ .cidr | ipaddr "address" }}`:                        "192.168.1.10",
+		`{{ .cidr | ipaddr "network" }}`:                        "192.168.1.0",
+		`{{ .cidr | ipaddr "netmask" }}`:                        "255.255.255.0",
+		`{{ .cidr | ipaddr "broadcast" }}`:                      "192.168.1.255",
+		`{{ .cidr | ipaddr "private" }}`:                        "192.168.1.10/24",
+		`{{ .cidr | ipaddr "public" }}`:                         "",
+		`{{ .name | ipaddr }}`:                                  "",
+	}
+	for text, expected := range cases {
+		rendered, err := renderTemplate("cmd", text, vars)
+		if err != nil {
+			t.Fatalf("Received error when rendering %v: %v\n", text, err)
+		}
+		if rendered != expected {
+			t.Fatalf("Rendering %v gave %q, expected %q\n", text, rendered, expected)
+		}
+	}
+}
+
+func TestTemplateFilterErrors(t *testing.T) {
+	for _, text := range []string{
+		`{{ "x" | hash "crc" }}`,
+		`{{ "x" | regex_search "(" }}`,
+		`{{ "not base64!" | b64decode }}`,
+	} {
+		if _, err := renderTemplate("cmd", text, map[string]interface{}{}); err == nil {
+			t.Fatalf("Expected an error when rendering %v\n", text)
+		}
+	}
+}
@@ -4,11 +4,29 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"strings"
 )
 
+// stringListFlag collects every value of a flag which may be repeated
+type stringListFlag []string
+
+func (s *stringListFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringListFlag) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
 func main() {
 
 	inventoryFlag := flag.String("inventory", "", "Path to inventory yaml file")
+	var extraVarsFlag stringListFlag
+	flag.Var(&extraVarsFlag, "extra-vars", "Variable as key=value, overriding all other variables (repeatable)")
+	flag.Var(&extraVarsFlag, "e", "Shorthand for --extra-vars")
+	forksFlag := flag.Int("forks", 0, "Number of hosts to run each task on at once, overrides the playbook's forks")
+	connectTimeoutFlag := flag.String("connect-timeout", "", "Seconds to wait when connecting to a host without a connect_timeout var")
 	flag.Parse()
 	if inventoryFlag == nil || *inventoryFlag == "" {
 		fmt.Printf("Please specify the --inventory flag\n")
@@ -16,7 +34,7 @@ func main() {
 	}
 
 	if flag.NArg() <= 0 {
-		fmt.Printf("Usage: goat --inventory <path to inventory>.yaml [playbook yaml]\n")
+		fmt.Printf("Usage: goat --inventory <path to inventory>.yaml [-e key=value] [--forks N] [--connect-timeout seconds] [playbook yaml]\n")
 		os.Exit(1)
 	}
 
@@ -26,12 +44,29 @@ func main() {
 		os.Exit(1)
 	}
 
+	extraVars, err := ParseExtraVars(extraVarsFlag)
+	if err != nil {
+		fmt.Printf("Error when reading extra vars: %v\n", err)
+		os.Exit(1)
+	}
+
+	connectTimeout, err := parseDuration(*connectTimeoutFlag)
+	if err != nil {
+		fmt.Printf("Invalid --connect-timeout: %v\n", err)
+		os.Exit(1)
+	}
+
 	playbookPath := flag.Args()[0]
-	playbook, err := PlaybookFromFilepath(playbookPath)
+	plays, err := PlaysFromFilepath(playbookPath)
 	if err != nil {
 		fmt.Printf("Error when reading playbook file: %v\n", err)
 		os.Exit(1)
 	}
-	
-	playbook.Execute(inventory)
+
+	runResult := plays.ExecuteWithOptions(inventory, ExecuteOptions{
+		ExtraVars:      extraVars,
+		Forks:          *forksFlag,
+		ConnectTimeout: connectTimeout,
+	})
+	fmt.Printf("%v", FormatRecap(runResult.Recap()))
 }
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Host keys are verified against ~/.ssh/known_hosts and goat's own
+// known_hosts file, ~/.goat/known_hosts unless the known_hosts_file host var
+// says otherwise. Both may contain hashed hostnames and @cert-authority lines.
+// The host_key_checking host var picks what happens to a host which isn't in
+// either file:
+//
+//	strict:     refuse to connect, the default
+//	accept-new: trust the key the first time and record it in goat's file
+//	off:        don't verify host keys at all
+//
+// A host whose key doesn't match the one recorded is always refused, unless
+// checking is off.
+const (
+	StrictHostKeyChecking    = "strict"
+	AcceptNewHostKeyChecking = "accept-new"
+	OffHostKeyChecking       = "off"
+)
+
+// Hosts are connected to concurrently, only one may record its key at a time
+var knownHostsMutex sync.Mutex
+
+// HostKeyError is returned when a host's key doesn't match the one recorded
+// for it, or the host is unknown and checking is strict
+type HostKeyError struct {
+	Hostname    string
+	Fingerprint string
+	Known       []knownhosts.KnownKey
+}
+
+func (h *HostKeyError) Error() string {
+	if len(h.Known) <= 0 {
+		return fmt.Sprintf("host key for %v isn't known, fingerprint %v", h.Hostname, h.Fingerprint)
+	}
+	known := make([]string, len(h.Known))
+	for index, key := range h.Known {
+		known[index] = fmt.Sprintf("%v %v at %v:%v", key.Key.Type(),
+			ssh.FingerprintSHA256(key.Key), key.Filename, key.Line)
+	}
+	return fmt.Sprintf("host key for %v has changed, got fingerprint %v, expected %v",
+		h.Hostname, h.Fingerprint, strings.Join(known, ", "))
+}
+
+// hostKeyChecker returns the callback verifying a host's key, along with the
+// host key algorithms to ask for so the host offers a key of a type which has
+// been recorded. No algorithms means any are accepted
+func hostKeyChecker(host *Host, hostname string) (ssh.HostKeyCallback, []string, error) {
+	mode := StrictHostKeyChecking
+	if value, exists := stringVar(host.Vars, "host_key_checking"); exists {
+		mode = value
+	}
+	switch mode {
+	case OffHostKeyChecking:
+		return ssh.InsecureIgnoreHostKey(), nil, nil
+	case StrictHostKeyChecking, AcceptNewHostKeyChecking:
+	default:
+		return nil, nil, fmt.Errorf("host_key_checking should be %v, %v or %v, got: %v",
+			StrictHostKeyChecking, AcceptNewHostKeyChecking, OffHostKeyChecking, mode)
+	}
+
+	goatFile, err := goatKnownHostsFile(host)
+	if err != nil {
+		return nil, nil, err
+	}
+	files := make([]string, 0, 2)
+	if home, err := os.UserHomeDir(); err == nil {
+		files = append(files, filepath.Join(home, ".ssh", "known_hosts"))
+	}
+	files = append(files, goatFile)
+	existing := make([]string, 0, len(files))
+	for _, file := range files {
+		if _, err := os.Stat(file); err == nil {
+			existing = append(existing, file)
+		}
+	}
+
+	knownCallback, err := knownhosts.New(existing...)
+	if err != nil {
+		return nil, nil, err
+	}
+	callback := func(address string, remote net.Addr, key ssh.PublicKey) error {
+		err := knownCallback(address, remote, key)
+		var keyErr *knownhosts.KeyError
+		if err == nil || !errors.As(err, &keyErr) {
+			return err
+		}
+		if len(keyErr.Want) <= 0 && mode == AcceptNewHostKeyChecking {
+			return recordHostKey(goatFile, address, remote, key)
+		}
+		return &HostKeyError{
+			Hostname:    address,
+			Fingerprint: ssh.FingerprintSHA256(key),
+			Known:       keyErr.Want,
+		}
+	}
+	if hasCertAuthority(existing) {
+		// Hosts may present certificates, which the default algorithms
+		// prefer
+		return callback, nil, nil
+	}
+	return callback, knownHostKeyAlgorithms(knownCallback, hostname), nil
+}
+
+func hasCertAuthority(files []string) bool {
+	for _, file := range files {
+		contents, err := os.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		for _, line := range strings.Split(string(contents), "\n") {
+			if strings.HasPrefix(strings.TrimSpace(line), "@cert-authority") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func goatKnownHostsFile(host *Host) (string, error) {
+	file, exists := stringVar(host.Vars, "known_hosts_file")
+	if !exists {
+		file = "~/.goat/known_hosts"
+	}
+	return expandHome(file)
+}
+
+// knownHostKeyAlgorithms asks the known hosts for a made up key, the error
+// lists the keys which have been recorded for the host
+func knownHostKeyAlgorithms(callback ssh.HostKeyCallback, hostname string) []string {
+	probe, err := ssh.NewPublicKey(ed25519.PublicKey(make([]byte, ed25519.PublicKeySize)))
+	if err != nil {
+		return nil
+	}
+	var keyErr *knownhosts.KeyError
+	err = callback(hostname, &net.TCPAddr{}, probe)
+	if !errors.As(err, &keyErr) {
+		return nil
+	}
+	algorithms := make([]string, 0, len(keyErr.Want))
+	for _, known := range keyErr.Want {
+		if known.Key.Type() == ssh.KeyAlgoRSA {
+			algorithms = append(algorithms, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256)
+		}
+		algorithms = append(algorithms, known.Key.Type())
+	}
+	if len(algorithms) <= 0 {
+		return nil
+	}
+	return algorithms
+}
+
+// recordHostKey appends a newly trusted key to goat's known_hosts file. The
+// file is read again first, another connection may have recorded a key for
+// the host since it was checked
+func recordHostKey(file, address string, remote net.Addr, key ssh.PublicKey) error {
+	knownHostsMutex.Lock()
+	defer knownHostsMutex.Unlock()
+	if _, err := os.Stat(file); err == nil {
+		recorded, err := knownhosts.New(file)
+		if err != nil {
+			return err
+		}
+		err = recorded(address, remote, key)
+		var keyErr *knownhosts.KeyError
+		if err == nil {
+			return nil
+		}
+		if !errors.As(err, &keyErr) {
+			return err
+		}
+		if len(keyErr.Want) > 0 {
+			return &HostKeyError{
+				Hostname:    address,
+				Fingerprint: ssh.FingerprintSHA256(key),
+				Known:       keyErr.Want,
+			}
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return err
+	}
+	knownHosts, err := os.OpenFile(file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer knownHosts.Close()
+	_, err = knownHosts.WriteString(knownhosts.Line([]string{knownhosts.Normalize(address)}, key) + "\n")
+	return err
+}
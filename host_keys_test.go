@@ -0,0 +1,165 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// connectWithHostKeys connects to a test server which accepts any password,
+// known_hosts files are read from a temporary home directory
+func connectWithHostKeys(t *testing.T, port, mode, knownHosts string) error {
+	knownHostsFile := filepath.Join(os.Getenv("HOME"), ".goat", "known_hosts")
+	if knownHosts != "" {
+		if err := os.MkdirAll(filepath.Dir(knownHostsFile), 0700); err != nil {
+			t.Fatalf("Unable to create known_hosts directory: %v\n", err)
+		}
+		if err := os.WriteFile(knownHostsFile, []byte(knownHosts), 0600); err != nil {
+			t.Fatalf("Unable to write known_hosts: %v\n", err)
+		}
+	}
+	conn := &SSHConnection{}
+	err := conn.Connect(testHost(map[string]interface{}{
+		"username":          "deploy",
+		"password":          "secret",
+		"port":              port,
+		"host_key_checking": mode,
+	}))
+	if err == nil {
+		conn.Client.Close()
+	}
+	return err
+}
+
+func acceptPassword() *ssh.ServerConfig {
+	return &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			return nil, nil
+		},
+	}
+}
+
+func TestHostKeyCheckingStrict(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("SSH_AUTH_SOCK", "")
+	port, hostKey := startTestSSHServer(t, acceptPassword(), nil)
+	address := knownhosts.Normalize("127.0.0.1:" + port)
+	fingerprint := ssh.FingerprintSHA256(hostKey.PublicKey())
+
+	err := connectWithHostKeys(t, port, StrictHostKeyChecking, "")
+	if err == nil || !strings.Contains(err.Error(), "isn't known") || !strings.Contains(err.Error(), fingerprint) {
+		t.Fatalf("Expected an unknown host error with the fingerprint, got %v\n", err)
+	}
+
+	err = connectWithHostKeys(t, port, StrictHostKeyChecking, knownhosts.Line([]string{address}, hostKey.PublicKey())+"\n")
+	if err != nil {
+		t.Fatalf("Expected a known host key to be accepted: %v\n", err)
+	}
+
+	hashed := knownhosts.Line([]string{knownhosts.HashHostname(address)}, hostKey.PublicKey())
+	err = connectWithHostKeys(t, port, StrictHostKeyChecking, hashed+"\n")
+	if err != nil {
+		t.Fatalf("Expected a hashed known host entry to be accepted: %v\n", err)
+	}
+
+	otherKey := generateTestSigner(t).PublicKey()
+	err = connectWithHostKeys(t, port, StrictHostKeyChecking, knownhosts.Line([]string{address}, otherKey)+"\n")
+	if err == nil || !strings.Contains(err.Error(), "has changed") || !strings.Contains(err.Error(), fingerprint) {
+		t.Fatalf("Expected a changed host key error with the fingerprint, got %v\n", err)
+	}
+	err = connectWithHostKeys(t, port, AcceptNewHostKeyChecking, "")
+	if err == nil {
+		t.Fatalf("accept-new shouldn't accept a changed host key\n")
+	}
+	if err := connectWithHostKeys(t, port, OffHostKeyChecking, ""); err != nil {
+		t.Fatalf("Expected any host key to be accepted with checking off: %v\n", err)
+	}
+}
+
+func TestHostKeyCheckingAcceptNew(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("SSH_AUTH_SOCK", "")
+	port, hostKey := startTestSSHServer(t, acceptPassword(), nil)
+
+	if err := connectWithHostKeys(t, port, AcceptNewHostKeyChecking, ""); err != nil {
+		t.Fatalf("Expected accept-new to trust an unknown host: %v\n", err)
+	}
+	recorded, err := os.ReadFile(filepath.Join(home, ".goat", "known_hosts"))
+	if err != nil {
+		t.Fatalf("Expected the host key to be recorded: %v\n", err)
+	}
+	expected := knownhosts.Line([]string{knownhosts.Normalize("127.0.0.1:" + port)}, hostKey.PublicKey())
+	if strings.TrimSpace(string(recorded)) != expected {
+		t.Fatalf("Expected %v to be recorded, got %v\n", expected, string(recorded))
+	}
+	if err := connectWithHostKeys(t, port, StrictHostKeyChecking, ""); err != nil {
+		t.Fatalf("Expected the recorded key to be trusted: %v\n", err)
+	}
+}
+
+func TestRecordHostKeyConcurrently(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "known_hosts")
+	key := generateTestSigner(t).PublicKey()
+	remote := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2222}
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for index := 0; index < 8; index++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- recordHostKey(file, "127.0.0.1:2222", remote, key)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("Unexpected error recording host key: %v\n", err)
+		}
+	}
+	recorded, _ := os.ReadFile(file)
+	if lines := strings.Count(string(recorded), "\n"); lines != 1 {
+		t.Fatalf("Expected the key to be recorded once, got %v lines\n", lines)
+	}
+
+	var keyErr *HostKeyError
+	err := recordHostKey(file, "127.0.0.1:2222", remote, generateTestSigner(t).PublicKey())
+	if !errors.As(err, &keyErr) || len(keyErr.Known) != 1 {
+		t.Fatalf("Expected a different key recorded meanwhile to be a mismatch, got %v\n", err)
+	}
+}
+
+func TestHostKeyCheckingCertAuthority(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("SSH_AUTH_SOCK", "")
+	authority := generateTestSigner(t)
+	hostKey := generateTestSigner(t)
+	cert := &ssh.Certificate{
+		Key:             hostKey.PublicKey(),
+		CertType:        ssh.HostCert,
+		ValidPrincipals: []string{"127.0.0.1"},
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+	if err := cert.SignCert(rand.Reader, authority); err != nil {
+		t.Fatalf("Unable to sign host certificate: %v\n", err)
+	}
+	certSigner, err := ssh.NewCertSigner(cert, hostKey)
+	if err != nil {
+		t.Fatalf("Unable to create certificate signer: %v\n", err)
+	}
+	port, _ := startTestSSHServer(t, acceptPassword(), certSigner)
+
+	authorityLine := fmt.Sprintf("@cert-authority %v %v", knownhosts.Normalize("127.0.0.1:"+port), strings.TrimSpace(string(ssh.MarshalAuthorizedKey(authority.PublicKey()))))
+	if err := connectWithHostKeys(t, port, StrictHostKeyChecking, authorityLine+"\n"); err != nil {
+		t.Fatalf("Expected a certificate signed by a known authority to be accepted: %v\n", err)
+	}
+}
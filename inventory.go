@@ -4,11 +4,15 @@ import (
 	"errors"
 	"fmt"
 	"gopkg.in/yaml.v3"
+	"math/rand"
 	"os"
+	"sort"
+	"time"
 )
 
 const (
 	HostNotFoundErrorCode = iota
+	InvalidPatternErrorCode
 )
 
 type InventoryError struct {
@@ -19,24 +23,68 @@ type InventoryError struct {
 func (i *InventoryError) HostNotFound() bool {
 	return i.errorCode == HostNotFoundErrorCode
 }
+
+func (i *InventoryError) InvalidPattern() bool {
+	return i.errorCode == InvalidPatternErrorCode
+}
 func (i *InventoryError) Error() string {
 	return i.Err.Error()
 }
 
 type Host struct {
-	Vars map[string]string `yaml:vars,omit=empty`
+	Vars map[string]interface{} `yaml:"vars,omitempty"`
 	name string
+	// The inventory layers Vars was merged from, see vars.go
+	layers []varLayer
+	// private_key_file came from the ssh config's IdentityFile, which like
+	// ssh is skipped when it can't be used, see hostAuth
+	configIdentityFile bool
 }
 
 type HostGroup struct {
-	Hosts    map[string]Host      `yaml:hosts,omit=empty`
-	Children map[string]HostGroup `yaml:children,omit=empty`
-	Vars     map[string]string    `yaml:vars,omit=empty`
+	Hosts    map[string]Host        `yaml:"hosts,omitempty"`
+	Children map[string]HostGroup   `yaml:"children,omitempty"`
+	Vars     map[string]interface{} `yaml:"vars,omitempty"`
+
+	// The order hosts and children were listed in the inventory file,
+	// go maps don't preserve it
+	hostOrder  []string
+	childOrder []string
+}
+
+func (g *HostGroup) UnmarshalYAML(value *yaml.Node) error {
+	type plainHostGroup HostGroup
+	if err := value.Decode((*plainHostGroup)(g)); err != nil {
+		return err
+	}
+	if value.Kind != yaml.MappingNode {
+		return nil
+	}
+	for index := 0; index+1 < len(value.Content); index += 2 {
+		switch value.Content[index].Value {
+		case "hosts":
+			g.hostOrder = mappingKeys(value.Content[index+1])
+		case "children":
+			g.childOrder = mappingKeys(value.Content[index+1])
+		}
+	}
+	return nil
+}
+
+func mappingKeys(node *yaml.Node) []string {
+	keys := make([]string, 0)
+	if node.Kind != yaml.MappingNode {
+		return keys
+	}
+	for index := 0; index+1 < len(node.Content); index += 2 {
+		keys = append(keys, node.Content[index].Value)
+	}
+	return keys
 }
 
 type Inventory struct {
-	All  HostGroup         `yaml:all,omit=empty`
-	Vars map[string]string `yaml:vars,omit=empty`
+	All  HostGroup              `yaml:"all,omitempty"`
+	Vars map[string]interface{} `yaml:"vars,omitempty"`
 }
 
 func InventoryFromFilepath(filepath string) (Inventory, error) {
@@ -53,9 +101,9 @@ func inventoryFromFileContents(contents []byte) (Inventory, error) {
 		All: HostGroup{
 			Hosts:    make(map[string]Host, 0),
 			Children: make(map[string]HostGroup, 0),
-			Vars:     make(map[string]string, 0),
+			Vars:     make(map[string]interface{}, 0),
 		},
-		Vars: make(map[string]string, 0),
+		Vars: make(map[string]interface{}, 0),
 	}
 	err := yaml.Unmarshal(contents, &inventory)
 	if err != nil {
@@ -64,160 +112,190 @@ func inventoryFromFileContents(contents []byte) (Inventory, error) {
 	return inventory, nil
 }
 
+// gatherHosts finds a single host in the inventory, with its variables merged
+// the same way as collectHosts
 func (i Inventory) gatherHosts(hostname string) (*Host, error) {
-	return i.All.gatherHosts(hostname)
+	for _, host := range i.collectHosts() {
+		if host.name == hostname {
+			return host, nil
+		}
+	}
+	return nil, &InventoryError{
+		errorCode: HostNotFoundErrorCode,
+		Err:       errors.New(fmt.Sprintf("Unable to locate host: %v\n", hostname)),
+	}
 }
 
-// Need to perform depth first search through host group's children.
-// The variables in the lower hostgroups will take precedence over the variables
-// in the upper, more generic hostgroups
 func (g HostGroup) gatherHosts(hostname string) (*Host, error) {
-	host := &Host{
-		Vars: make(map[string]string, 0),
-	}
-	for hostKey, existingHost := range g.Hosts {
-		if hostKey == hostname {
-			for variableKey, value := range existingHost.Vars {
-				if _, keyExists := host.Vars[variableKey]; !keyExists {
-					host.Vars[variableKey] = value
-				}
-			}
-		}
-	}
-	for _, hostgroup := range g.Children {
-		bubbledHost, err := hostgroup.gatherHosts(hostname)
-		if err != nil {
-			invErr, ok := err.(*InventoryError)
-			if ok {
-				if invErr.HostNotFound() {
-					continue
-				}
-			}
-			return nil, err
-		}
-		for variableKey, value := range bubbledHost.Vars {
-			host.Vars[variableKey] = value
-		}
+	return Inventory{All: g}.gatherHosts(hostname)
+}
 
+const (
+	InventoryOrder        = "inventory"
+	ReverseInventoryOrder = "reverse_inventory"
+	SortedOrder           = "sorted"
+	ReverseSortedOrder    = "reverse_sorted"
+	ShuffleOrder          = "shuffle"
+)
+
+// ExecutionHosts resolves host patterns (see hostPattern) against the inventory.
+// Each matching host is returned exactly once, in the order it first appears in
+// the inventory file, with a single merged set of variables (see collectHosts)
+func (i Inventory) ExecutionHosts(patterns []string) ([]*Host, error) {
+	pattern, err := parseHostPatterns(patterns)
+	if err != nil {
+		return nil, err
+	}
+	selected, err := pattern.resolve(i.index())
+	if err != nil {
+		return nil, err
 	}
 
-	if len(host.Vars) <= 0 {
-		return nil, &InventoryError{
-			errorCode: HostNotFoundErrorCode,
-			Err:       errors.New(fmt.Sprintf("Unable to locate host: %v\n", hostname)),
+	hosts := make([]*Host, 0, len(selected))
+	for _, host := range i.collectHosts() {
+		if selected[host.name] {
+			hosts = append(hosts, host)
 		}
 	}
-	return host, nil
+	return hosts, nil
 }
 
-// Similar to the gather function, this performs a depth first search through
-// an inventory's hosts and hostgroups. The variables in the lower/inner hosts and host groups
-// will take precedence over the variables in the upper/outer hostgroups
-// should a hostgroup name match one of the names passed as a parameter
-// all hosts in that hostgroup will be a part of the returned []*Host
-func (i Inventory) ExecutionHosts(names []string) []*Host {
-	for _, name := range names {
-		if name == "all" {
-			return i.All.collectAllHosts()
+// OrderHosts returns the hosts, which are expected to be in inventory order,
+// rearranged by one of the order constants. An empty order is inventory order
+func OrderHosts(hosts []*Host, order string) ([]*Host, error) {
+	ordered := make([]*Host, len(hosts))
+	copy(ordered, hosts)
+	switch order {
+	case "", InventoryOrder:
+	case ReverseInventoryOrder:
+		for left, right := 0, len(ordered)-1; left < right; left, right = left+1, right-1 {
+			ordered[left], ordered[right] = ordered[right], ordered[left]
 		}
+	case SortedOrder:
+		sort.SliceStable(ordered, func(a, b int) bool {
+			return ordered[a].name < ordered[b].name
+		})
+	case ReverseSortedOrder:
+		sort.SliceStable(ordered, func(a, b int) bool {
+			return ordered[a].name > ordered[b].name
+		})
+	case ShuffleOrder:
+		shuffler := rand.New(rand.NewSource(time.Now().UnixNano()))
+		shuffler.Shuffle(len(ordered), func(a, b int) {
+			ordered[a], ordered[b] = ordered[b], ordered[a]
+		})
+	default:
+		return nil, fmt.Errorf("Unknown host order: %v", order)
 	}
-	return i.All.findHosts(names)
+	return ordered, nil
 }
 
-func (g HostGroup) findHosts(names []string) []*Host {
-	groupHosts := g.findHostsInGroup(names)
-	groupHosts = extend(groupHosts, g.findHostsInChildren(names))
-	return groupHosts
+// hostListing is a single place a host is listed in the inventory, along with
+// every group on the path down to it, outermost first
+type hostListing struct {
+	groups []groupListing
+	vars   map[string]interface{}
 }
 
-func (g HostGroup) findHostsInGroup(names []string) []*Host {
-	groupHosts := make([]*Host, 0)
-	for _, searchName := range names {
-		for hostKey, host := range g.Hosts {
-			if hostKey == searchName {
-				newHost := &Host{
-					Vars: make(map[string]string, len(host.Vars)),
-				}
-				for varKey, varValue := range g.Vars {
-					newHost.Vars[varKey] = varValue
-				}
-				for varKey, varValue := range host.Vars {
-					newHost.Vars[varKey] = varValue
-				}
-				newHost.name = hostKey
-				groupHosts = append(groupHosts, newHost)
-				
-			}
-		}
-	}
-	return groupHosts
+type groupListing struct {
+	path  string
+	depth int
+	vars  map[string]interface{}
 }
 
-func (h *Host) addParentVars(parentGroup HostGroup) {
-	for varKey, varValue := range parentGroup.Vars {
-		if _, keyExists := h.Vars[varKey]; !keyExists {
-			h.Vars[varKey] = varValue
+// collectHosts returns every host in the inventory once, in the order each
+// host first appears. A host's variables start from the inventory's vars. As
+// a host may be listed in several places its variables are then merged from
+// every listing: group variables are applied from the shallowest groups to
+// the deepest, with groups of equal depth applied in inventory order, and the
+// host's own variables are applied last, again in inventory order. So the
+// nearer a variable is to the host the higher its precedence. These are the
+// inventory steps of the precedence described in vars.go, they're kept on the
+// host so a playbook's var_merge can merge them again
+func (i Inventory) collectHosts() []*Host {
+	order := make([]string, 0)
+	listings := make(map[string][]hostListing, 0)
+	i.All.walk("all", []groupListing{}, func(hostKey string, listing hostListing) {
+		if _, seen := listings[hostKey]; !seen {
+			order = append(order, hostKey)
 		}
-	}
-}
+		listings[hostKey] = append(listings[hostKey], listing)
+	})
 
-func (g HostGroup) findHostsInChildren(names []string) []*Host {
-	hosts := make([]*Host, 0)
-	for _, searchName := range names {
-		for subgroupName, subgroup := range g.Children {
-			if subgroupName == searchName {
-				foundHosts := subgroup.collectAllHosts()
-				hosts = extend(hosts, foundHosts)
-				continue
-			}
-			foundHosts := subgroup.findHostsInChildren(names)
-			hosts = extend(hosts, foundHosts)
-			hostsInSubgroup := subgroup.findHostsInGroup(names)
-			hosts = extend(hosts, hostsInSubgroup)
-			for _, host := range hosts {
-				host.addParentVars(g)
+	hosts := make([]*Host, 0, len(order))
+	for _, hostKey := range order {
+		groups := make([]groupListing, 0)
+		seenGroups := make(map[string]bool, 0)
+		for _, listing := range listings[hostKey] {
+			for _, group := range listing.groups {
+				if !seenGroups[group.path] {
+					seenGroups[group.path] = true
+					groups = append(groups, group)
+				}
 			}
 		}
-	}
-	return hosts
-}
+		sort.SliceStable(groups, func(a, b int) bool {
+			return groups[a].depth < groups[b].depth
+		})
 
-func (g HostGroup) collectAllHosts() []*Host {
-	hosts := make([]*Host, 0)
-	for hostKey, host := range g.Hosts {
-		newHost := &Host{
-			Vars: make(map[string]string, 0),
+		layers := []varLayer{{step: InventoryVarsStep, vars: i.Vars}}
+		for _, group := range groups {
+			layers = append(layers, varLayer{step: GroupVarsStep, vars: group.vars})
 		}
-		for varKey, varValue := range g.Vars {
-			newHost.Vars[varKey] = varValue
+		for _, listing := range listings[hostKey] {
+			layers = append(layers, varLayer{step: HostVarsStep, vars: listing.vars})
 		}
-		for varKey, varValue := range host.Vars {
-			newHost.Vars[varKey] = varValue
+		newHost := &Host{
+			Vars:   mergeVarLayers(layers, nil),
+			name:   hostKey,
+			layers: layers,
 		}
-		newHost.name = hostKey
 		hosts = append(hosts, newHost)
 	}
-	for _, subgroup := range g.Children {
-		hosts = extend(hosts, subgroup.collectAllHosts())
-	}
 	return hosts
 }
 
-func extend(a, b []*Host) []*Host {
+// walk performs a depth first search through the group in inventory order,
+// calling visit for every host listing. The group's own hosts are visited
+// before its children's
+func (g HostGroup) walk(path string, ancestors []groupListing, visit func(string, hostListing)) {
+	groups := make([]groupListing, len(ancestors), len(ancestors)+1)
+	copy(groups, ancestors)
+	groups = append(groups, groupListing{
+		path:  path,
+		depth: len(ancestors),
+		vars:  g.Vars,
+	})
 
-	if len(b) <= 0 {
-		return a
+	for _, hostKey := range orderedKeys(g.hostOrder, g.Hosts) {
+		visit(hostKey, hostListing{
+			groups: groups,
+			vars:   g.Hosts[hostKey].Vars,
+		})
+	}
+	for _, subgroupName := range orderedKeys(g.childOrder, g.Children) {
+		g.Children[subgroupName].walk(path+"/"+subgroupName, groups, visit)
 	}
+}
 
-	c := make([]*Host, len(a)+len(b))
-	index := 0
-	for _, value := range a {
-		c[index] = value
-		index++
+// orderedKeys returns the keys of a map in the order they were read from the
+// inventory file. Keys which weren't read from a file, such as those of groups
+// built in code, follow in sorted order
+func orderedKeys[V any](order []string, m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	seen := make(map[string]bool, len(m))
+	for _, key := range order {
+		if _, exists := m[key]; exists && !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
 	}
-	for _, value := range b {
-		c[index] = value
-		index++
+	remaining := make([]string, 0)
+	for key := range m {
+		if !seen[key] {
+			remaining = append(remaining, key)
+		}
 	}
-	return c
+	sort.Strings(remaining)
+	return append(keys, remaining...)
 }
@@ -410,7 +410,10 @@ func TestExecutionHostsWithNoGroupMatches(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Failed to initialize inventory for test! %v\n", err)
 	}
-	hosts := inventory.ExecutionHosts([]string{"ssh1"})
+	hosts, err := inventory.ExecutionHosts([]string{"ssh1"})
+	if err != nil {
+		t.Fatalf("Received error when resolving Execution Hosts: %v\n", err)
+	}
 	if len(hosts) <= 0 {
 		t.Fatalf("Didn't receive enough hosts when trying to get Execution Hosts\n")
 	}
@@ -428,7 +431,10 @@ func TestExecutionHostsWithOneGroupMatch(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Failed to initialize inventory for test! %v\n", err)
 	}
-	hosts := inventory.ExecutionHosts([]string{"group"})
+	hosts, err := inventory.ExecutionHosts([]string{"group"})
+	if err != nil {
+		t.Fatalf("Received error when resolving Execution Hosts: %v\n", err)
+	}
 	if len(hosts) < 2 {
 		fmt.Printf("Inventory: %+v\n", inventory)
 		t.Fatalf("Didn't receive enough hosts when trying to get Execution Hosts - %+v\n", hosts)
@@ -450,7 +456,10 @@ func TestExecutionHostsWithTwoSubMatch(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Failed to initialize inventory for test! %v\n", err)
 	}
-	hosts := inventory.ExecutionHosts([]string{"linux"})
+	hosts, err := inventory.ExecutionHosts([]string{"linux"})
+	if err != nil {
+		t.Fatalf("Received error when resolving Execution Hosts: %v\n", err)
+	}
 	if len(hosts) < 2 {
 		fmt.Printf("Inventory: %+v\n", inventory)
 		t.Fatalf("Didn't receive enough hosts when trying to get Execution Hosts - %+v\n", hosts)
@@ -482,3 +491,93 @@ func buildInventory(t *testing.T, contents []byte) (Inventory, error) {
 	}
 	return inventory, nil
 }
+
+var executionHostsOrdered = []byte(`
+all:
+  hosts:
+    zeta:
+    alpha:
+  children:
+    web:
+      hosts:
+        mid:
+          vars:
+            role: web
+        alpha:
+      vars:
+        role: group
+        depth: web
+    db:
+      children:
+        primary:
+          hosts:
+            mid:
+              vars:
+                role: db
+          vars:
+            depth: primary
+`)
+
+func TestExecutionHostsDeduplicatedInInventoryOrder(t *testing.T) {
+	inventory, err := buildInventory(t, executionHostsOrdered)
+	if err != nil {
+		t.Fatalf("Failed to initialize inventory for test! %v\n", err)
+	}
+	for attempt := 0; attempt < 10; attempt++ {
+		hosts, err := inventory.ExecutionHosts([]string{"all"})
+		if err != nil {
+			t.Fatalf("Received error when resolving Execution Hosts: %v\n", err)
+		}
+		names := make([]string, 0, len(hosts))
+		for _, host := range hosts {
+			names = append(names, host.name)
+		}
+		if fmt.Sprintf("%v", names) != "[zeta alpha mid]" {
+			t.Fatalf("Hosts weren't unique and in inventory order: %v\n", names)
+		}
+		mid := hosts[2]
+		if mid.Vars["role"] != "db" {
+			t.Fatalf("Later host vars should take precedence, got role: %v\n", mid.Vars["role"])
+		}
+		if mid.Vars["depth"] != "primary" {
+			t.Fatalf("Deeper group vars should take precedence, got depth: %v\n", mid.Vars["depth"])
+		}
+	}
+}
+
+func TestOrderHosts(t *testing.T) {
+	inventory, err := buildInventory(t, executionHostsOrdered)
+	if err != nil {
+		t.Fatalf("Failed to initialize inventory for test! %v\n", err)
+	}
+	hosts, err := inventory.ExecutionHosts([]string{"all"})
+	if err != nil {
+		t.Fatalf("Received error when resolving Execution Hosts: %v\n", err)
+	}
+	cases := map[string]string{
+		InventoryOrder:        "[zeta alpha mid]",
+		ReverseInventoryOrder: "[mid alpha zeta]",
+		SortedOrder:           "[alpha mid zeta]",
+		ReverseSortedOrder:    "[zeta mid alpha]",
+	}
+	for order, expected := range cases {
+		ordered, err := OrderHosts(hosts, order)
+		if err != nil {
+			t.Fatalf("Received error when ordering hosts by %v: %v\n", order, err)
+		}
+		names := make([]string, 0, len(ordered))
+		for _, host := range ordered {
+			names = append(names, host.name)
+		}
+		if fmt.Sprintf("%v", names) != expected {
+			t.Fatalf("Order %v returned %v, expected %v\n", order, names, expected)
+		}
+	}
+	shuffled, err := OrderHosts(hosts, ShuffleOrder)
+	if err != nil || len(shuffled) != len(hosts) {
+		t.Fatalf("Shuffle should return every host: %v, %v\n", shuffled, err)
+	}
+	if _, err := OrderHosts(hosts, "backwards"); err == nil {
+		t.Fatalf("Expected an error for an unknown order\n")
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Hosts which can only be reached through a bastion set the proxy_jump host
+// var. Like OpenSSH's ProxyJump it's a comma separated list of hops, each
+// [user@]address[:port], which are connected through in order:
+//
+//	proxy_jump: deploy@bastion.example.com,deploy@inner-bastion:2222
+//
+// or a list where each hop is either a string or a mapping of connection
+// vars, for hops which need their own key or password:
+//
+//	proxy_jump:
+//	  - address: bastion.example.com
+//	    username: jump
+//	    private_key_file: ~/.ssh/bastion
+//	  - inner-bastion
+//
+// A hop is looked up in the ssh config like any other host, and uses the
+// target host's connection vars for anything neither it nor the ssh config
+// set. Connections to a hop are shared by every host behind it for the rest
+// of the run.
+
+// jumpClient is a shared connection to a hop, once dialed it's reused until
+// it stops working
+type jumpClient struct {
+	mutex  sync.Mutex
+	client *ssh.Client
+}
+
+// jumpClients holds the connections to hops for a run, see hostConnections
+type jumpClients struct {
+	mutex sync.Mutex
+	// Keyed by the chain of hops leading to and including the hop
+	byChain map[string]*jumpClient
+}
+
+func newJumpClients() *jumpClients {
+	return &jumpClients{byChain: make(map[string]*jumpClient, 0)}
+}
+
+// jumpHops returns a Host for each hop a host is connected through
+func jumpHops(host *Host) ([]*Host, error) {
+	value, exists := host.Vars["proxy_jump"]
+	if !exists || value == nil {
+		return nil, nil
+	}
+	specs := make([]interface{}, 0)
+	switch v := value.(type) {
+	case []interface{}:
+		specs = v
+	default:
+		for _, hop := range strings.Split(toString(v), ",") {
+			specs = append(specs, hop)
+		}
+	}
+
+	hops := make([]*Host, 0, len(specs))
+	for _, spec := range specs {
+		vars := make(map[string]interface{}, 0)
+		switch s := spec.(type) {
+		case map[string]interface{}:
+			for key, varValue := range s {
+				vars[key] = varValue
+			}
+		default:
+			hop := strings.TrimSpace(toString(s))
+			if username, address, found := strings.Cut(hop, "@"); found {
+				vars["username"] = username
+				hop = address
+			}
+			if address, port, found := strings.Cut(hop, ":"); found {
+				vars["port"] = port
+				hop = address
+			}
+			vars["address"] = hop
+		}
+		address, exists := stringVar(vars, "address")
+		if !exists || address == "" {
+			return nil, errors.New(fmt.Sprintf("proxy_jump hop %v has no address", len(hops)+1))
+		}
+		if _, exists := vars["ssh_config_file"]; !exists && host.Vars["ssh_config_file"] != nil {
+			vars["ssh_config_file"] = host.Vars["ssh_config_file"]
+		}
+		hop, err := withSSHConfig(&Host{Vars: vars, name: address})
+		if err != nil {
+			return nil, err
+		}
+		for key, varValue := range host.Vars {
+			switch key {
+			case "address", "port", "proxy_jump":
+				continue
+			}
+			if _, exists := hop.Vars[key]; !exists {
+				hop.Vars[key] = varValue
+			}
+		}
+		delete(hop.Vars, "proxy_jump")
+		hops = append(hops, hop)
+	}
+	return hops, nil
+}
+
+// jumpKey identifies a chain of hops, two hosts share a connection to a hop
+// when they reach it the same way as the same user
+func jumpKey(hops []*Host) string {
+	keys := make([]string, len(hops))
+	for index, hop := range hops {
+		username, _ := stringVar(hop.Vars, "username")
+		keys[index] = fmt.Sprintf("%v@%v", username, hostURI(hop))
+	}
+	return strings.Join(keys, ",")
+}
+
+// get returns the connection to the last of hops, connecting through the
+// hops before it when there isn't already one
+func (j *jumpClients) get(hops []*Host, defaultTimeout time.Duration) (*ssh.Client, error) {
+	key := jumpKey(hops)
+	j.mutex.Lock()
+	shared, exists := j.byChain[key]
+	if !exists {
+		shared = &jumpClient{}
+		j.byChain[key] = shared
+	}
+	j.mutex.Unlock()
+
+	// Hosts behind the same hop wait for the first to connect rather than
+	// each connecting to it
+	shared.mutex.Lock()
+	defer shared.mutex.Unlock()
+	if shared.client != nil {
+		// A hop which has dropped its connection is connected to again
+		if _, _, err := shared.client.SendRequest("keepalive@openssh.com", true, nil); err == nil {
+			return shared.client, nil
+		}
+		shared.client.Close()
+		shared.client = nil
+	}
+
+	var via *ssh.Client
+	if len(hops) > 1 {
+		var err error
+		via, err = j.get(hops[:len(hops)-1], defaultTimeout)
+		if err != nil {
+			return nil, err
+		}
+	}
+	client, err := dialSSH(via, hops[len(hops)-1], defaultTimeout)
+	if err != nil {
+		var connErr *ConnectionError
+		if errors.As(err, &connErr) {
+			connErr.Err = errors.New(fmt.Sprintf("Error connecting to jump host %v: %v",
+				hops[len(hops)-1].name, connErr.Err))
+		}
+		return nil, err
+	}
+	shared.client = client
+	return client, nil
+}
+
+// closeAll closes every hop's connection, those furthest along a chain first
+// since they're reached through the others
+func (j *jumpClients) closeAll() {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	keys := make([]string, 0, len(j.byChain))
+	for key := range j.byChain {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(a, b int) bool {
+		return strings.Count(keys[a], ",") > strings.Count(keys[b], ",")
+	})
+	for _, key := range keys {
+		shared := j.byChain[key]
+		shared.mutex.Lock()
+		if shared.client != nil {
+			shared.client.Close()
+			shared.client = nil
+		}
+		shared.mutex.Unlock()
+		delete(j.byChain, key)
+	}
+}
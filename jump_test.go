@@ -0,0 +1,88 @@
+package main
+
+import (
+	"golang.org/x/crypto/ssh"
+	"sync/atomic"
+	"testing"
+)
+
+// countingServer accepts any password, counting how many clients connect
+func countingServer(t *testing.T) (string, *int32) {
+	var connections int32
+	port, _ := startTestSSHServer(t, &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			atomic.AddInt32(&connections, 1)
+			return nil, nil
+		},
+	}, nil)
+	return port, &connections
+}
+
+func TestJumpHops(t *testing.T) {
+	hops, err := jumpHops(testHost(map[string]interface{}{
+		"username":   "deploy",
+		"password":   "secret",
+		"port":       "2200",
+		"proxy_jump": "jump@bastion:2222,inner",
+	}))
+	if err != nil || len(hops) != 2 {
+		t.Fatalf("Expected two hops, got %v %v\n", hops, err)
+	}
+	if jumpKey(hops) != "jump@bastion:2222,deploy@inner:22" {
+		t.Fatalf("Unexpected hops %v\n", jumpKey(hops))
+	}
+	if password, _ := stringVar(hops[1].Vars, "password"); password != "secret" {
+		t.Fatalf("A hop should use the host's vars it doesn't set itself: %v\n", hops[1].Vars)
+	}
+
+	hops, err = jumpHops(testHost(map[string]interface{}{
+		"username": "deploy",
+		"proxy_jump": []interface{}{
+			map[string]interface{}{"address": "bastion", "username": "jump", "private_key_file": "~/.ssh/bastion"},
+		},
+	}))
+	if err != nil || len(hops) != 1 || hops[0].Vars["private_key_file"] != "~/.ssh/bastion" {
+		t.Fatalf("Expected a hop with its own key, got %v %v\n", hops, err)
+	}
+
+	_, err = jumpHops(testHost(map[string]interface{}{
+		"proxy_jump": []interface{}{map[string]interface{}{"username": "jump"}},
+	}))
+	if err == nil {
+		t.Fatalf("Expected an error for a hop without an address\n")
+	}
+}
+
+func TestSSHConnectThroughSharedJumpHosts(t *testing.T) {
+	t.Setenv("SSH_AUTH_SOCK", "")
+	bastionPort, bastionConnections := countingServer(t)
+	innerPort, innerConnections := countingServer(t)
+	targetPort, targetConnections := countingServer(t)
+
+	jumps := newJumpClients()
+	for index := 0; index < 3; index++ {
+		conn := &SSHConnection{jumps: jumps}
+		err := conn.Connect(testHost(map[string]interface{}{
+			"username":          "deploy",
+			"password":          "secret",
+			"port":              targetPort,
+			"host_key_checking": "off",
+			"proxy_jump": []interface{}{
+				"jump@127.0.0.1:" + bastionPort,
+				map[string]interface{}{"address": "127.0.0.1", "port": innerPort, "username": "inner"},
+			},
+		}))
+		if err != nil {
+			t.Fatalf("Expected to connect through the jump hosts: %v\n", err)
+		}
+		conn.Close()
+	}
+	jumps.closeAll()
+	if *targetConnections != 3 {
+		t.Fatalf("Expected every host to connect to the target, got %v\n", *targetConnections)
+	}
+	if *bastionConnections != 1 || *innerConnections != 1 {
+		t.Fatalf("Expected the jump host connections to be shared, got %v and %v\n",
+			*bastionConnections, *innerConnections)
+	}
+}
@@ -18,6 +18,11 @@ func (s StdoutFormatter) Output(taskName, hostname string, result TaskResult) st
 	sb.WriteString(fmt.Sprintf("task: %v\n", taskName))
 	sb.WriteString(fmt.Sprintf("\thost: %v\n", hostname))
 
+	if result.Skipped() {
+		sb.WriteString("\t\tskipped\n")
+		return sb.String()
+	}
+
 	taskErr := result.Error()
 	if taskErr != nil {
 		sb.WriteString(fmt.Sprintf("\t\terror: %v\n", taskErr.Error()))
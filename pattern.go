@@ -0,0 +1,301 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// A host pattern selects hosts from an inventory. A pattern is made up of
+// terms separated by ':' (or ',' when the pattern contains one). Each term is
+// matched against both host names and group names, a matching group selects
+// every host beneath it. Terms may be:
+//
+//	all, *          every host in the inventory
+//	web1, dbs       an exact host or group name
+//	web*, db?       a shell style glob
+//	db[01:12]       a numeric or alphabetic range, optionally with a stride
+//	~^app-\d+$      a regular expression
+//
+// Terms prefixed with '&' intersect with the hosts selected so far and terms
+// prefixed with '!' exclude hosts. As with ansible, unions are applied first,
+// then intersections, then exclusions, so the order of terms doesn't matter.
+// A pattern made up only of intersections and exclusions starts from all.
+type hostPattern struct {
+	unions        []string
+	intersections []string
+	exclusions    []string
+}
+
+// parseHostPatterns combines the terms of every pattern, so a playbook's
+// hosts list behaves the same as its entries joined into a single pattern
+func parseHostPatterns(patterns []string) (hostPattern, error) {
+	parsed := hostPattern{}
+	for _, pattern := range patterns {
+		for _, term := range splitHostPattern(pattern) {
+			term = strings.TrimSpace(term)
+			if term == "" {
+				continue
+			}
+			switch term[0] {
+			case '&', '!':
+				if strings.TrimSpace(term[1:]) == "" {
+					return hostPattern{}, invalidPatternError(pattern, "empty term")
+				}
+				if term[0] == '&' {
+					parsed.intersections = append(parsed.intersections, strings.TrimSpace(term[1:]))
+				} else {
+					parsed.exclusions = append(parsed.exclusions, strings.TrimSpace(term[1:]))
+				}
+			default:
+				parsed.unions = append(parsed.unions, term)
+			}
+		}
+	}
+	if len(parsed.unions) <= 0 && (len(parsed.intersections) > 0 || len(parsed.exclusions) > 0) {
+		parsed.unions = []string{"all"}
+	}
+	return parsed, nil
+}
+
+// Patterns containing a ',' are split on it, otherwise they're split on ':'.
+// A ':' inside of brackets belongs to a range and never splits a term.
+func splitHostPattern(pattern string) []string {
+	if strings.Contains(pattern, ",") {
+		return strings.Split(pattern, ",")
+	}
+	terms := make([]string, 0)
+	depth := 0
+	start := 0
+	for index, char := range pattern {
+		switch char {
+		case '[':
+			depth++
+		case ']':
+			if depth > 0 {
+				depth--
+			}
+		case ':':
+			if depth == 0 {
+				terms = append(terms, pattern[start:index])
+				start = index + 1
+			}
+		}
+	}
+	return append(terms, pattern[start:])
+}
+
+func invalidPatternError(pattern, reason string) error {
+	return &InventoryError{
+		errorCode: InvalidPatternErrorCode,
+		Err:       fmt.Errorf("Invalid host pattern %q: %v", pattern, reason),
+	}
+}
+
+// resolve returns the set of host names selected by the pattern
+func (p hostPattern) resolve(index inventoryIndex) (map[string]bool, error) {
+	selected := make(map[string]bool, 0)
+	for _, term := range p.unions {
+		matched, err := index.matchTerm(term)
+		if err != nil {
+			return nil, err
+		}
+		for name := range matched {
+			selected[name] = true
+		}
+	}
+	for _, term := range p.intersections {
+		matched, err := index.matchTerm(term)
+		if err != nil {
+			return nil, err
+		}
+		for name := range selected {
+			if !matched[name] {
+				delete(selected, name)
+			}
+		}
+	}
+	for _, term := range p.exclusions {
+		matched, err := index.matchTerm(term)
+		if err != nil {
+			return nil, err
+		}
+		for name := range matched {
+			delete(selected, name)
+		}
+	}
+	return selected, nil
+}
+
+// inventoryIndex holds every host name in an inventory, as well as the names
+// of the hosts beneath each group, so that patterns can be resolved against
+// names without walking the inventory for each term
+type inventoryIndex struct {
+	hosts  map[string]bool
+	groups map[string]map[string]bool
+}
+
+func (i Inventory) index() inventoryIndex {
+	index := inventoryIndex{
+		hosts:  make(map[string]bool, 0),
+		groups: make(map[string]map[string]bool, 0),
+	}
+	index.addGroup("all", i.All)
+	return index
+}
+
+func (x inventoryIndex) addGroup(groupName string, g HostGroup) map[string]bool {
+	members, exists := x.groups[groupName]
+	if !exists {
+		members = make(map[string]bool, 0)
+		x.groups[groupName] = members
+	}
+	for hostKey := range g.Hosts {
+		x.hosts[hostKey] = true
+		members[hostKey] = true
+	}
+	for subgroupName, subgroup := range g.Children {
+		for hostKey := range x.addGroup(subgroupName, subgroup) {
+			members[hostKey] = true
+		}
+	}
+	return members
+}
+
+func (x inventoryIndex) matchTerm(term string) (map[string]bool, error) {
+	matched := make(map[string]bool, 0)
+	if term == "all" || term == "*" {
+		for name := range x.hosts {
+			matched[name] = true
+		}
+		return matched, nil
+	}
+
+	var matches func(string) bool
+	if strings.HasPrefix(term, "~") {
+		expression, err := regexp.Compile(term[1:])
+		if err != nil {
+			return nil, invalidPatternError(term, err.Error())
+		}
+		matches = expression.MatchString
+	} else {
+		candidates, err := expandHostRanges(term)
+		if err != nil {
+			return nil, err
+		}
+		for _, candidate := range candidates {
+			if _, err := path.Match(candidate, ""); err != nil {
+				return nil, invalidPatternError(term, err.Error())
+			}
+		}
+		matches = func(name string) bool {
+			for _, candidate := range candidates {
+				if ok, _ := path.Match(candidate, name); ok {
+					return true
+				}
+			}
+			return false
+		}
+	}
+
+	for name := range x.hosts {
+		if matches(name) {
+			matched[name] = true
+		}
+	}
+	for groupName, members := range x.groups {
+		if !matches(groupName) {
+			continue
+		}
+		for name := range members {
+			matched[name] = true
+		}
+	}
+	return matched, nil
+}
+
+// maxHostRangeSize is the most hosts a term's ranges may expand to, a typo
+// such as web[1:99999999] is an error rather than exhausting memory
+const maxHostRangeSize = 10000
+
+var hostRangeExpression = regexp.MustCompile(`\[([^\]:]*):([^\]:]*)(?::([^\]:]*))?\]`)
+
+// expandHostRanges expands the first [start:end] or [start:end:stride] range in
+// a term, recursing for any ranges which remain. Numeric ranges keep the zero
+// padding of their start, db[01:03] expands to db01, db02 and db03.
+func expandHostRanges(term string) ([]string, error) {
+	location := hostRangeExpression.FindStringSubmatchIndex(term)
+	if location == nil {
+		return []string{term}, nil
+	}
+	prefix := term[:location[0]]
+	suffix := term[location[1]:]
+	start := term[location[2]:location[3]]
+	end := term[location[4]:location[5]]
+	stride := 1
+	if location[6] >= 0 {
+		parsedStride, err := strconv.Atoi(term[location[6]:location[7]])
+		if err != nil || parsedStride <= 0 {
+			return nil, invalidPatternError(term, "range stride must be a positive integer")
+		}
+		stride = parsedStride
+	}
+
+	values, err := rangeValues(start, end, stride)
+	if err != nil {
+		return nil, invalidPatternError(term, err.Error())
+	}
+
+	remainders, err := expandHostRanges(suffix)
+	if err != nil {
+		return nil, err
+	}
+	if len(values)*len(remainders) > maxHostRangeSize {
+		return nil, invalidPatternError(term, fmt.Sprintf("ranges expand to more than %v hosts", maxHostRangeSize))
+	}
+	expanded := make([]string, 0, len(values)*len(remainders))
+	for _, value := range values {
+		for _, remainder := range remainders {
+			expanded = append(expanded, prefix+value+remainder)
+		}
+	}
+	return expanded, nil
+}
+
+func rangeValues(start, end string, stride int) ([]string, error) {
+	if start == "" {
+		start = "0"
+	}
+	startNumber, startErr := strconv.Atoi(start)
+	endNumber, endErr := strconv.Atoi(end)
+	if startErr == nil && endErr == nil {
+		if endNumber < startNumber {
+			return nil, fmt.Errorf("range end %v is before start %v", end, start)
+		}
+		if (endNumber-startNumber)/stride >= maxHostRangeSize {
+			return nil, fmt.Errorf("range [%v:%v] expands to more than %v hosts", start, end, maxHostRangeSize)
+		}
+		values := make([]string, 0)
+		for value := startNumber; value <= endNumber; value += stride {
+			values = append(values, fmt.Sprintf("%0*d", len(start), value))
+		}
+		return values, nil
+	}
+	if len(start) == 1 && len(end) == 1 && isASCIILetter(start[0]) && isASCIILetter(end[0]) {
+		if end[0] < start[0] {
+			return nil, fmt.Errorf("range end %v is before start %v", end, start)
+		}
+		values := make([]string, 0)
+		for value := int(start[0]); value <= int(end[0]); value += stride {
+			values = append(values, string(rune(value)))
+		}
+		return values, nil
+	}
+	return nil, fmt.Errorf("range [%v:%v] must be numeric or a single letter", start, end)
+}
+
+func isASCIILetter(char byte) bool {
+	return (char >= 'a' && char <= 'z') || (char >= 'A' && char <= 'Z')
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"testing"
+)
+
+var patternInventory = []byte(`
+all:
+  hosts:
+    canary:
+  children:
+    web:
+      hosts:
+        web01:
+        web02:
+        web03:
+    db:
+      hosts:
+        db01:
+        db02:
+        db12:
+    prod:
+      hosts:
+        web01:
+        db01:
+        app-7:
+`)
+
+func patternHostNames(t *testing.T, inventory Inventory, patterns ...string) string {
+	hosts, err := inventory.ExecutionHosts(patterns)
+	if err != nil {
+		t.Fatalf("Received error when resolving %v: %v\n", patterns, err)
+	}
+	unique := make(map[string]bool, 0)
+	for _, host := range hosts {
+		unique[host.name] = true
+	}
+	names := make([]string, 0, len(unique))
+	for name := range unique {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+func TestExecutionHostsPatterns(t *testing.T) {
+	inventory, err := buildInventory(t, patternInventory)
+	if err != nil {
+		t.Fatalf("Failed to initialize inventory for test! %v\n", err)
+	}
+
+	cases := []struct {
+		patterns []string
+		expected string
+	}{
+		{[]string{"web*"}, "web01,web02,web03"},
+		{[]string{"db[01:02]"}, "db01,db02"},
+		{[]string{"db[1:12]"}, "db12"},
+		{[]string{`~^app-\d+$`}, "app-7"},
+		{[]string{"web:db"}, "db01,db02,db12,web01,web02,web03"},
+		{[]string{"web", "canary"}, "canary,web01,web02,web03"},
+		{[]string{"web:&prod"}, "web01"},
+		{[]string{"all:!canary:!web"}, "app-7,db01,db02,db12"},
+		{[]string{"!prod"}, "canary,db02,db12,web02,web03"},
+		{[]string{"db,web0[2:3]"}, "db01,db02,db12,web02,web03"},
+		{[]string{"nothere"}, ""},
+	}
+	for _, c := range cases {
+		names := patternHostNames(t, inventory, c.patterns...)
+		if names != c.expected {
+			t.Fatalf("Pattern %v resolved to %v, expected %v\n", c.patterns, names, c.expected)
+		}
+	}
+}
+
+func TestExecutionHostsInvalidPattern(t *testing.T) {
+	inventory, err := buildInventory(t, patternInventory)
+	if err != nil {
+		t.Fatalf("Failed to initialize inventory for test! %v\n", err)
+	}
+	for _, pattern := range []string{"~web[", "db[12:01]", "web:!", "web[1:99999999]", "db[0:999]-[0:99]"} {
+		_, err := inventory.ExecutionHosts([]string{pattern})
+		if err == nil {
+			t.Fatalf("Expected an error for invalid pattern %v\n", pattern)
+		}
+		invErr, ok := err.(*InventoryError)
+		if !ok || !invErr.InvalidPattern() {
+			t.Fatalf("Error should've been InvalidPattern: %v\n", err)
+		}
+	}
+}
+
+func TestExpandHostRanges(t *testing.T) {
+	expanded, err := expandHostRanges("db[08:10]-[a:b]")
+	if err != nil {
+		t.Fatalf("Received error when expanding range: %v\n", err)
+	}
+	expected := "db08-a,db08-b,db09-a,db09-b,db10-a,db10-b"
+	if strings.Join(expanded, ",") != expected {
+		t.Fatalf("Expected %v, got %v\n", expected, expanded)
+	}
+	expanded, err = expandHostRanges("web[1:9:4]")
+	if err != nil {
+		t.Fatalf("Received error when expanding range: %v\n", err)
+	}
+	if strings.Join(expanded, ",") != "web1,web5,web9" {
+		t.Fatalf("Stride wasn't respected: %v\n", expanded)
+	}
+}
@@ -1,29 +1,122 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"gopkg.in/yaml.v3"
 	"os"
+	"strings"
+	"sync"
+	"time"
 )
 
 type Playbook struct {
-	Name  string            `yaml:name`
-	Hosts []string          `yaml:hosts`
-	Vars  map[string]string `yaml:vars,omit=empty`
-	Tasks []CommandTask     `yaml:tasks`
+	Name  string                 `yaml:"name"`
+	Hosts []string               `yaml:"hosts"`
+	Vars  map[string]interface{} `yaml:"vars,omitempty"`
+	Tasks []CommandTask          `yaml:"tasks"`
+	// Order hosts are executed in, one of inventory (the default),
+	// reverse_inventory, sorted, reverse_sorted or shuffle
+	Order string `yaml:"order,omitempty"`
+	// How each variable precedence step merges with the steps below it,
+	// see vars.go
+	VarMerge map[string]string `yaml:"var_merge,omitempty"`
+	// How tasks are run across hosts, linear (the default) or free, see
+	// strategy.go
+	Strategy string `yaml:"strategy,omitempty"`
+	// Run the play on batches of hosts rather than all at once, see serial.go
+	Serial Serial `yaml:"serial,omitempty"`
+	// How many hosts a task runs on at once, --forks takes precedence
+	Forks int `yaml:"forks,omitempty"`
+	// Abort the play for every host as soon as any host fails a task
+	AnyErrorsFatal bool `yaml:"any_errors_fatal,omitempty"`
+	// Abort the play once more than this percentage of its hosts have failed
+	MaxFailPercentage *float64 `yaml:"max_fail_percentage,omitempty"`
+	// Run every task as another user, tasks may override these, see
+	// become.go
+	Become       *bool  `yaml:"become,omitempty"`
+	BecomeUser   string `yaml:"become_user,omitempty"`
+	BecomeMethod string `yaml:"become_method,omitempty"`
+	// Directory of the file the play was read from, relative paths in file
+	// tasks are relative to it
+	baseDir string
 }
 
+// Every string field of a task is rendered as a template before the task
+// runs (see template.go), unless it's tagged with `template:"-"`
 type CommandTask struct {
-	Name string `yaml:name`
-	Cmd  string `yaml:cmd`
+	Name string                 `yaml:"name" template:"-"`
+	Cmd  string                 `yaml:"cmd"`
+	Vars map[string]interface{} `yaml:"vars,omitempty" template:"-"`
+	// The task only runs on hosts where every condition is true, see
+	// conditional.go
+	When Conditions `yaml:"when,omitempty" template:"-"`
+	// Name of a variable the task's result is stored in on each host, for
+	// the tasks which follow
+	Register string `yaml:"register,omitempty" template:"-"`
+	// Override whether the task failed or changed anything. The task's own
+	// result is available to them under its register name, or as result
+	FailedWhen  Conditions `yaml:"failed_when,omitempty" template:"-"`
+	ChangedWhen Conditions `yaml:"changed_when,omitempty" template:"-"`
+	// A failure of the task doesn't count against the host
+	IgnoreErrors bool `yaml:"ignore_errors,omitempty"`
+	// Stop the command once it's run for this long, in seconds or as a
+	// duration such as 1m30s
+	Timeout string `yaml:"timeout,omitempty"`
+	// Run the task as another user, overriding the play, see become.go
+	Become       *bool  `yaml:"become,omitempty"`
+	BecomeUser   string `yaml:"become_user,omitempty"`
+	BecomeMethod string `yaml:"become_method,omitempty"`
+	// Upload a file instead of running cmd, see copy.go
+	Copy *CopyModule `yaml:"copy,omitempty"`
+	// Render a template file and upload it, see template_task.go
+	Template *TemplateModule `yaml:"template,omitempty"`
+	// Download files from the host, see fetch.go
+	Fetch *FetchModule `yaml:"fetch,omitempty"`
+	// Make a remote directory match a local one, see synchronize.go
+	Synchronize *SynchronizeModule `yaml:"synchronize,omitempty"`
+	// Upload a local script and run it, see script.go
+	Script *ScriptModule `yaml:"script,omitempty"`
 }
 
+// ExecuteOptions are the settings for a playbook run which don't come from
+// the playbook itself, usually from the command line
+type ExecuteOptions struct {
+	ExtraVars map[string]interface{}
+	// Overrides the playbook's forks when greater than zero
+	Forks int
+	// How long to wait when connecting to a host without a connect_timeout
+	// var, DefaultConnectTimeout when zero
+	ConnectTimeout time.Duration
+}
+
+// DefaultForks is how many hosts a task runs on at once when neither the
+// playbook or options say otherwise
+const DefaultForks = 5
+
 const (
 	NotInitiatedConnection = iota
 	SuccessfulConnection
 	FailedConnection
 )
 
+// Why a task failed, see TaskResult.FailureCategory
+const (
+	NoFailure = iota
+	ConnectionFailure
+	AuthFailure
+	CommandFailure
+	TimeoutFailure
+)
+
+var failureCategoryNames = map[int]string{
+	NoFailure:         "",
+	ConnectionFailure: "connection",
+	AuthFailure:       "auth",
+	CommandFailure:    "command",
+	TimeoutFailure:    "timeout",
+}
+
 type PlaybookResult map[string]map[string]TaskResult
 
 func PlaybookFromFilepath(filepath string) (Playbook, error) {
@@ -31,22 +124,63 @@ func PlaybookFromFilepath(filepath string) (Playbook, error) {
 	if err != nil {
 		return Playbook{}, err
 	}
-	return playbookFromContents(contents)
+	playbook, err := playbookFromContents(contents)
+	if err != nil {
+		return Playbook{}, err
+	}
+	playbook.baseDir = playbookDir(filepath)
+	return playbook, nil
 }
 
 func playbookFromContents(contents []byte) (Playbook, error) {
-	playbook := Playbook{
-		Hosts: make([]string, 0),
-		Vars:  make(map[string]string),
-		Tasks: make([]CommandTask, 0),
-	}
+	playbook := newPlaybook()
 	err := yaml.Unmarshal(contents, &playbook)
 	if err != nil {
 		return Playbook{}, err
 	}
+	if err := playbook.validate(); err != nil {
+		return Playbook{}, err
+	}
 	return playbook, nil
 }
 
+func newPlaybook() Playbook {
+	return Playbook{
+		Hosts: make([]string, 0),
+		Vars:  make(map[string]interface{}),
+		Tasks: make([]CommandTask, 0),
+	}
+}
+
+func (p Playbook) validate() error {
+	if err := validateVarMerge(p.VarMerge); err != nil {
+		return err
+	}
+	if _, exists := strategies[p.Strategy]; !exists && p.Strategy != "" {
+		return fmt.Errorf("Unknown strategy: %v", p.Strategy)
+	}
+	if err := validateBecomeMethod(p.BecomeMethod); err != nil {
+		return err
+	}
+	for _, task := range p.Tasks {
+		if err := validateBecomeMethod(task.BecomeMethod); err != nil {
+			return fmt.Errorf("Task %v: %v", task.Name, err)
+		}
+		if err := task.validateModule(); err != nil {
+			return fmt.Errorf("Task %v: %v", task.Name, err)
+		}
+	}
+	return p.Serial.validate()
+}
+
+// RunOptions change how a command is run on a host
+type RunOptions struct {
+	// Run the command as another user, nil to run it as the connecting user
+	Become *Become
+	// Stop the command once it's run for this long, zero for no limit
+	Timeout time.Duration
+}
+
 type executingHost struct {
 	Host *Host
 	conn Connection
@@ -54,9 +188,50 @@ type executingHost struct {
 
 type Connection interface {
 	Connect(*Host) error
-	Run(string) TaskResult
+	Run(string, RunOptions) TaskResult
 	Status() int
 	SetConnectionError(error)
+	Close() error
+}
+
+// hostConnections holds a connection per host for a whole run, so every play
+// and serial batch reuses a host's connection rather than connecting again.
+// They're closed once the run is over, along with the jump hosts they share
+type hostConnections struct {
+	connectTimeout time.Duration
+	mutex          sync.Mutex
+	byHost         map[string]Connection
+	jumps          *jumpClients
+}
+
+func newHostConnections(options ExecuteOptions) *hostConnections {
+	return &hostConnections{
+		connectTimeout: options.ConnectTimeout,
+		byHost:         make(map[string]Connection, 0),
+		jumps:          newJumpClients(),
+	}
+}
+
+// get returns a host's connection, creating it the first time
+func (h *hostConnections) get(hostname string) Connection {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	conn, exists := h.byHost[hostname]
+	if !exists {
+		conn = &SSHConnection{ConnectTimeout: h.connectTimeout, jumps: h.jumps}
+		h.byHost[hostname] = conn
+	}
+	return conn
+}
+
+func (h *hostConnections) closeAll() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for hostname, conn := range h.byHost {
+		conn.Close()
+		delete(h.byHost, hostname)
+	}
+	h.jumps.closeAll()
 }
 
 type TaskResult interface {
@@ -65,39 +240,528 @@ type TaskResult interface {
 	Stderr() string
 	StderrBytes() []byte
 	Error() error
+	Skipped() bool
+	// ExitCode is the remote command's exit status, or -1 when the command
+	// didn't exit normally
+	ExitCode() int
+	// Signal is the name of the signal which killed the remote command
+	Signal() string
+	// FailureCategory is one of the failure constants, NoFailure when the
+	// task succeeded
+	FailureCategory() int
+	Changed() bool
+	Failed() bool
+	Start() time.Time
+	End() time.Time
+}
+
+// localResult is the result of a task which never reached its host, such as
+// one whose templates failed to render or whose when condition was false
+type localResult struct {
+	err      error
+	skipped  bool
+	category int
+	start    time.Time
+	end      time.Time
 }
 
+func (l localResult) StdoutBytes() []byte {
+	return []byte{}
+}
+
+func (l localResult) StderrBytes() []byte {
+	return []byte{}
+}
+
+func (l localResult) Stdout() string {
+	return ""
+}
+
+func (l localResult) Stderr() string {
+	return ""
+}
+
+func (l localResult) Error() error {
+	return l.err
+}
+
+func (l localResult) Skipped() bool {
+	return l.skipped
+}
+
+func (l localResult) ExitCode() int {
+	if l.err != nil {
+		return -1
+	}
+	return 0
+}
+
+func (l localResult) Signal() string {
+	return ""
+}
+
+func (l localResult) FailureCategory() int {
+	return l.category
+}
+
+func (l localResult) Changed() bool {
+	return false
+}
+
+func (l localResult) Failed() bool {
+	return l.err != nil
+}
+
+func (l localResult) Start() time.Time {
+	return l.start
+}
+
+func (l localResult) End() time.Time {
+	return l.end
+}
+
+// evaluatedResult is a result whose failed and changed flags have been
+// decided by a task's failed_when and changed_when
+type evaluatedResult struct {
+	TaskResult
+	failed  bool
+	changed bool
+}
+
+func (e evaluatedResult) Failed() bool {
+	return e.failed
+}
+
+func (e evaluatedResult) Changed() bool {
+	return e.changed
+}
+
+func (e evaluatedResult) Error() error {
+	if !e.failed {
+		return nil
+	}
+	if err := e.TaskResult.Error(); err != nil {
+		return err
+	}
+	return errors.New("failed_when condition was true")
+}
+
+func (e evaluatedResult) FailureCategory() int {
+	if !e.failed {
+		return NoFailure
+	}
+	if category := e.TaskResult.FailureCategory(); category != NoFailure {
+		return category
+	}
+	return CommandFailure
+}
 
 func (p Playbook) Execute(inventory Inventory) PlaybookResult {
+	return p.ExecuteWithOptions(inventory, ExecuteOptions{})
+}
+
+func (p Playbook) ExecuteWithOptions(inventory Inventory, options ExecuteOptions) PlaybookResult {
+	connections := newHostConnections(options)
+	defer connections.closeAll()
+	result, _ := p.execute(inventory, options, NewVarResolver(options.ExtraVars), connections, make(map[string]bool, 0))
+	return result
+}
+
+// execute runs the play on its hosts, skipping those in failed which were
+// removed by an earlier play. Hosts which fail are added to failed and the
+// returned bool is whether the play was aborted. Registered variables live in
+// resolver and connections in connections, so they're shared with later plays
+func (p Playbook) execute(inventory Inventory, options ExecuteOptions, resolver *VarResolver, connections *hostConnections, failed map[string]bool) (PlaybookResult, bool) {
+	result := make(PlaybookResult, 0)
+	hosts, err := inventory.ExecutionHosts(p.Hosts)
+	if err != nil {
+		fmt.Printf("Error resolving playbook hosts: %v\n", err)
+		return result, true
+	}
+	hosts, err = OrderHosts(hosts, p.Order)
+	if err != nil {
+		fmt.Printf("Error ordering playbook hosts: %v\n", err)
+		return result, true
+	}
+	remaining := make([]*Host, 0, len(hosts))
+	for _, host := range hosts {
+		if !failed[host.name] {
+			remaining = append(remaining, host)
+		}
+	}
+	batches, err := p.Serial.batches(remaining)
+	if err != nil {
+		fmt.Printf("Error batching playbook hosts: %v\n", err)
+		return result, true
+	}
+	for index, batch := range batches {
+		run := newPlayRun(p, batch, resolver, result, options, connections)
+		strategyByName(p.Strategy).run(run)
+		for hostname := range run.failed {
+			failed[hostname] = true
+		}
+		if run.isAborted() {
+			return result, true
+		}
+		// Like a batch over the failure threshold, a batch in which every
+		// host failed stops the batches after it
+		if index < len(batches)-1 && len(batch) > 0 && len(run.failed) >= len(batch) {
+			fmt.Printf("Aborting play %v: every host in a serial batch failed\n", p.Name)
+			return result, true
+		}
+	}
+	return result, false
+}
+
+// playRun is the state of a single execution of a playbook
+type playRun struct {
+	play      Playbook
+	hosts     []*Host
+	executing map[string]executingHost
+	resolver  *VarResolver
+	result    PlaybookResult
+	formatter OutputFormatter
+	forks     int
+	// Guards result, failed and failedThisTask as well as the output, so
+	// results can be recorded from any goroutine
+	mutex sync.Mutex
+	// Hosts which failed a task, or couldn't be connected to, and take no
+	// further part in the play
+	failed map[string]bool
+	// Whether a host failed since failures were last checked
+	failedThisTask bool
+	// Set once the play has been aborted, no more tasks should start
+	aborted bool
+}
 
-	hosts := inventory.ExecutionHosts(p.Hosts)
-	stdoutFormatter := StdoutFormatter{}
-	executionHosts := make(map[string]executingHost, len(hosts))
+func newPlayRun(play Playbook, hosts []*Host, resolver *VarResolver, result PlaybookResult, options ExecuteOptions, connections *hostConnections) *playRun {
+	forks := options.Forks
+	if forks <= 0 {
+		forks = play.Forks
+	}
+	if forks <= 0 {
+		forks = DefaultForks
+	}
+	executing := make(map[string]executingHost, len(hosts))
 	for _, host := range hosts {
-		hostAddress := fmt.Sprintf("%v", host)
-		executionHosts[hostAddress] = executingHost{
+		executing[host.name] = executingHost{
 			Host: host,
-			conn: &SSHConnection{},
+			conn: connections.get(host.name),
 		}
 	}
-	result := make(PlaybookResult, 0)
-	for _, task := range p.Tasks {
-		result[task.Name] = make(map[string]TaskResult, 0)
-		for _, host := range hosts {
-			executionHost := executionHosts[fmt.Sprintf("%v", host)]
-			if status := executionHost.conn.Status(); status == FailedConnection {
-				continue
-			} else if status == NotInitiatedConnection {
-				if err := executionHost.conn.Connect(executionHost.Host); err != nil {
-					fmt.Printf("Error connecting to host: %v - %v\n", host.name, err)
-					executionHost.conn.SetConnectionError(err)
-					continue
-				}
+	return &playRun{
+		play:      play,
+		hosts:     hosts,
+		executing: executing,
+		resolver:  resolver,
+		result:    result,
+		formatter: StdoutFormatter{},
+		forks:     forks,
+		failed:    make(map[string]bool, len(hosts)),
+	}
+}
+
+// runTaskOnHosts runs a task on every host, at most forks of them at once,
+// returning once the task has finished everywhere. Results are returned in
+// the same order as hosts
+func (r *playRun) runTaskOnHosts(task CommandTask, hosts []*Host) []TaskResult {
+	results := make([]TaskResult, len(hosts))
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for worker := 0; worker < r.forks && worker < len(hosts); worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range indexes {
+				results[index] = r.play.runTask(task, r.executing[hosts[index].name], r.resolver)
 			}
-			cmdResult := executionHost.conn.Run(task.Cmd)
-			result[task.Name][host.name] = cmdResult
-			fmt.Printf(stdoutFormatter.Output(task.Name, host.name, cmdResult))
+		}()
+	}
+	for index := range hosts {
+		indexes <- index
+	}
+	close(indexes)
+	wg.Wait()
+	return results
+}
+
+// startTask prepares the results for a task, it must be called before the
+// task runs on any host
+func (r *playRun) startTask(task CommandTask) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if _, exists := r.result[task.Name]; !exists {
+		r.result[task.Name] = make(map[string]TaskResult, 0)
+	}
+}
+
+// abort stops the play for every host
+func (r *playRun) abort(err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if !r.aborted {
+		fmt.Printf("Aborting play %v: %v\n", r.play.Name, err)
+	}
+	r.aborted = true
+}
+
+func (r *playRun) isAborted() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.aborted
+}
+
+// hasFailed is whether a host has been removed from the play
+func (r *playRun) hasFailed(host *Host) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.failed[host.name]
+}
+
+// activeHosts returns the hosts which haven't failed, in execution order
+func (r *playRun) activeHosts() []*Host {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	active := make([]*Host, 0, len(r.hosts))
+	for _, host := range r.hosts {
+		if !r.failed[host.name] {
+			active = append(active, host)
 		}
 	}
-	return result
+	return active
+}
+
+// record stores a task's result for a host and prints it. A host which
+// failed the task is removed from the rest of the play, unless the task
+// ignores errors. ignore_errors can't save a host which couldn't be reached
+// or authenticated with
+func (r *playRun) record(task CommandTask, host *Host, taskResult TaskResult) {
+	if task.Register != "" {
+		r.resolver.Register(host, task.Register, registeredResult(taskResult))
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.result[task.Name][host.name] = taskResult
+	output := r.formatter.Output(task.Name, host.name, taskResult)
+
+	if taskResult.Failed() {
+		category := taskResult.FailureCategory()
+		if task.IgnoreErrors && category != ConnectionFailure && category != AuthFailure {
+			output += "\t\tignoring error\n"
+		} else {
+			r.failed[host.name] = true
+			r.failedThisTask = true
+		}
+	}
+	fmt.Print(output)
+}
+
+// checkFailures returns an error when the play should be aborted: a host has
+// failed since the last check and the play has any_errors_fatal, or more of
+// the play's hosts have failed than its max_fail_percentage allows
+func (r *playRun) checkFailures() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	failedThisTask := r.failedThisTask
+	r.failedThisTask = false
+	if r.play.AnyErrorsFatal && failedThisTask {
+		return errors.New("a host failed and any_errors_fatal is set")
+	}
+	if r.play.MaxFailPercentage != nil && len(r.hosts) > 0 {
+		failedPercentage := float64(len(r.failed)) / float64(len(r.hosts)) * 100
+		if failedPercentage > *r.play.MaxFailPercentage {
+			return fmt.Errorf("%.1f%% of hosts have failed, more than max_fail_percentage %v%%",
+				failedPercentage, *r.play.MaxFailPercentage)
+		}
+	}
+	return nil
+}
+
+// runTask runs a single task on a host
+func (p Playbook) runTask(task CommandTask, executionHost executingHost, resolver *VarResolver) TaskResult {
+	host := executionHost.Host
+	started := time.Now()
+	vars := resolver.ResolveVars(host, p, task)
+	shouldRun, err := task.When.Evaluate(vars)
+	if err != nil {
+		return localResult{err: err, category: CommandFailure, start: started, end: time.Now()}
+	}
+	if !shouldRun {
+		return localResult{skipped: true, start: started, end: time.Now()}
+	}
+	renderedTask, err := renderTask(task, vars)
+	if err != nil {
+		return localResult{err: err, category: CommandFailure, start: started, end: time.Now()}
+	}
+	become, err := p.taskBecome(renderedTask, vars)
+	if err != nil {
+		return localResult{err: err, category: CommandFailure, start: started, end: time.Now()}
+	}
+	timeout, err := parseDuration(renderedTask.Timeout)
+	if err != nil {
+		return localResult{err: fmt.Errorf("Invalid timeout: %v", err), category: CommandFailure, start: started, end: time.Now()}
+	}
+	options := RunOptions{Become: become, Timeout: timeout}
+	if executionHost.conn.Status() == NotInitiatedConnection {
+		connectionHost := &Host{
+			Vars: vars,
+			name: host.name,
+		}
+		if err := executionHost.conn.Connect(connectionHost); err != nil {
+			executionHost.conn.SetConnectionError(err)
+			category := ConnectionFailure
+			if connErr, ok := err.(*ConnectionError); ok {
+				category = connErr.Category()
+			}
+			return localResult{err: err, category: category, start: started, end: time.Now()}
+		}
+	}
+	return evaluateResult(task, vars, p.runModule(renderedTask, host, vars, executionHost.conn, options))
+}
+
+// runModule runs whatever the task does on a connected host, its cmd unless
+// it's one of the other task types
+func (p Playbook) runModule(task CommandTask, host *Host, vars map[string]interface{}, conn Connection, options RunOptions) TaskResult {
+	switch {
+	case task.Copy != nil:
+		return runCopy(*task.Copy, p.baseDir, conn, options)
+	case task.Template != nil:
+		return runTemplate(*task.Template, p.baseDir, vars, conn, options)
+	case task.Fetch != nil:
+		return runFetch(*task.Fetch, p.baseDir, host.name, conn, options)
+	case task.Synchronize != nil:
+		return runSynchronize(*task.Synchronize, p.baseDir, conn, options)
+	case task.Script != nil:
+		return runScript(*task.Script, p.baseDir, conn, options)
+	}
+	return conn.Run(task.Cmd, options)
+}
+
+// validateModule checks a task does only one thing
+func (c CommandTask) validateModule() error {
+	modules := make([]string, 0)
+	if c.Cmd != "" {
+		modules = append(modules, "cmd")
+	}
+	if c.Copy != nil {
+		modules = append(modules, "copy")
+	}
+	if c.Template != nil {
+		modules = append(modules, "template")
+	}
+	if c.Fetch != nil {
+		modules = append(modules, "fetch")
+	}
+	if c.Synchronize != nil {
+		modules = append(modules, "synchronize")
+	}
+	if c.Script != nil {
+		modules = append(modules, "script")
+	}
+	if len(modules) > 1 {
+		return fmt.Errorf("Only one of %v may be set", strings.Join(modules, ", "))
+	}
+	switch {
+	case c.Copy != nil:
+		return c.Copy.validate()
+	case c.Template != nil:
+		return c.Template.validate()
+	case c.Fetch != nil:
+		return c.Fetch.validate()
+	case c.Synchronize != nil:
+		return c.Synchronize.validate()
+	case c.Script != nil:
+		return c.Script.validate()
+	}
+	return nil
+}
+
+// evaluateResult applies a task's failed_when and changed_when to its result
+func evaluateResult(task CommandTask, vars map[string]interface{}, result TaskResult) TaskResult {
+	if len(task.FailedWhen) <= 0 && len(task.ChangedWhen) <= 0 {
+		return result
+	}
+	// A failure to reach the host can't be overridden, a command which timed
+	// out can
+	if category := result.FailureCategory(); category == ConnectionFailure || category == AuthFailure {
+		return result
+	}
+
+	resultName := task.Register
+	if resultName == "" {
+		resultName = "result"
+	}
+	vars[resultName] = registeredResult(result)
+
+	evaluated := evaluatedResult{
+		TaskResult: result,
+		failed:     result.Failed(),
+		changed:    result.Changed(),
+	}
+	if len(task.FailedWhen) > 0 {
+		failed, err := task.FailedWhen.Evaluate(vars)
+		if err != nil {
+			return localResult{err: err, category: CommandFailure, start: result.Start(), end: result.End()}
+		}
+		evaluated.failed = failed
+	}
+	if len(task.ChangedWhen) > 0 {
+		changed, err := task.ChangedWhen.Evaluate(vars)
+		if err != nil {
+			return localResult{err: err, category: CommandFailure, start: result.Start(), end: result.End()}
+		}
+		evaluated.changed = changed
+	}
+	return evaluated
+}
+
+// registeredResult is what a task's register makes available to later tasks,
+// e.g. {{ .uptime.stdout }} or when: uptime.rc != 0
+func registeredResult(result TaskResult) map[string]interface{} {
+	registered := map[string]interface{}{
+		"stdout":       result.Stdout(),
+		"stderr":       result.Stderr(),
+		"stdout_lines": outputLines(result.Stdout()),
+		"stderr_lines": outputLines(result.Stderr()),
+		"rc":           result.ExitCode(),
+		"signal":       result.Signal(),
+		"failure":      failureCategoryNames[result.FailureCategory()],
+		"changed":      result.Changed(),
+		"failed":       result.Failed(),
+		"skipped":      result.Skipped(),
+		"start":        result.Start().Format(time.RFC3339Nano),
+		"end":          result.End().Format(time.RFC3339Nano),
+		"delta":        result.End().Sub(result.Start()).Seconds(),
+		"msg":          "",
+	}
+	if err := result.Error(); err != nil {
+		registered["msg"] = err.Error()
+	}
+	if evaluated, ok := result.(evaluatedResult); ok {
+		result = evaluated.TaskResult
+	}
+	if detailed, ok := result.(detailedResult); ok {
+		for key, value := range detailed.Details() {
+			registered[key] = value
+		}
+	}
+	return registered
+}
+
+// detailedResult is a result with more to register than a command's, such
+// as a copied file's checksum
+type detailedResult interface {
+	Details() map[string]interface{}
+}
+
+func outputLines(output string) []interface{} {
+	lines := make([]interface{}, 0)
+	output = strings.TrimRight(output, "\r\n")
+	if output == "" {
+		return lines
+	}
+	for _, line := range strings.Split(output, "\n") {
+		lines = append(lines, strings.TrimSuffix(line, "\r"))
+	}
+	return lines
 }
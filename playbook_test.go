@@ -7,7 +7,11 @@ import (
 	"github.com/docker/docker/client"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 var shortPlaybookContents = []byte(`
@@ -126,12 +130,13 @@ func TestPlaybookExecuteShortResults(t *testing.T) {
 
 func dockerSSH1Host() Host {
 	dockerSSHContainer1 := Host{
-		Vars: make(map[string]string, 4),
+		Vars: make(map[string]interface{}, 5),
 	}
 	dockerSSHContainer1.Vars["address"] = "localhost"
 	dockerSSHContainer1.Vars["port"] = "2221"
 	dockerSSHContainer1.Vars["username"] = "test"
 	dockerSSHContainer1.Vars["password"] = "test"
+	dockerSSHContainer1.Vars["host_key_checking"] = "off"
 	return dockerSSHContainer1
 }
 
@@ -261,3 +266,512 @@ func TestPlaybookExecuteErrResults(t *testing.T) {
 		t.Fatalf("Expected task one - host ss1 to have error")
 	}		
 }
+
+var skippedPlaybookContents = []byte(`
+name: Skipped Playbook
+hosts:
+  - all
+vars:
+  os_family: redhat
+tasks:
+  - name: debian only
+    cmd: apt-get update
+    when: os_family == "debian"
+`)
+
+func TestPlaybookExecuteSkipsFalseConditions(t *testing.T) {
+	hostGroup := HostGroup{
+		Hosts: map[string]Host{"unreachable": {}},
+	}
+	inventory := Inventory{
+		All: hostGroup,
+	}
+	playbook := createTestPlaybook(t, skippedPlaybookContents)
+
+	playbookResults := playbook.Execute(inventory)
+	taskResult, keyExists := playbookResults["debian only"]["unreachable"]
+	if !keyExists {
+		t.Fatalf("Expected a result for the skipped task: %v\n", playbookResults)
+	}
+	if !taskResult.Skipped() || taskResult.Error() != nil {
+		t.Fatalf("Task should've been skipped without an error: %+v\n", taskResult)
+	}
+}
+
+var registerPlaybookContents = []byte(`
+name: Register Playbook
+hosts:
+  - all
+tasks:
+  - name: first
+    cmd: uptime
+    when: false
+    register: uptime
+  - name: second
+    cmd: echo {{ .uptime.rc }}
+    when: not uptime.skipped or uptime.rc != 0
+`)
+
+func TestPlaybookExecuteRegistersResults(t *testing.T) {
+	inventory := Inventory{
+		All: HostGroup{
+			Hosts: map[string]Host{"unreachable": {}},
+		},
+	}
+	playbook := createTestPlaybook(t, registerPlaybookContents)
+
+	playbookResults := playbook.Execute(inventory)
+	taskResult, keyExists := playbookResults["second"]["unreachable"]
+	if !keyExists {
+		t.Fatalf("Expected a result for the second task: %v\n", playbookResults)
+	}
+	if !taskResult.Skipped() || taskResult.Error() != nil {
+		t.Fatalf("Second task should've seen the registered result and been skipped: %+v\n", taskResult)
+	}
+}
+
+func TestRegisteredResult(t *testing.T) {
+	registered := registeredResult(localResult{err: fmt.Errorf("boom")})
+	if registered["failed"] != true || registered["rc"] != -1 || registered["msg"] != "boom" {
+		t.Fatalf("Registered result is incorrect: %v\n", registered)
+	}
+	lines := outputLines("one\r\ntwo\n\n")
+	if len(lines) != 2 || lines[0] != "one" || lines[1] != "two" {
+		t.Fatalf("Output lines are incorrect: %#v\n", lines)
+	}
+}
+
+func TestEvaluateResultFailedAndChangedWhen(t *testing.T) {
+	commandFailed := localResult{err: fmt.Errorf("exit status 1"), category: CommandFailure}
+
+	task := CommandTask{
+		Register:    "grep",
+		FailedWhen:  Conditions{"grep.rc > 1 or grep.failure != 'command'"},
+		ChangedWhen: Conditions{"false"},
+	}
+	evaluated := evaluateResult(task, map[string]interface{}{}, commandFailed)
+	if evaluated.Failed() || evaluated.Error() != nil || evaluated.FailureCategory() != NoFailure {
+		t.Fatalf("failed_when should've overridden the failure: %+v\n", evaluated)
+	}
+	if evaluated.Changed() {
+		t.Fatalf("changed_when should've overridden changed: %+v\n", evaluated)
+	}
+
+	task = CommandTask{
+		FailedWhen: Conditions{"'error' in result.stdout or result.rc == 0"},
+	}
+	evaluated = evaluateResult(task, map[string]interface{}{}, localResult{})
+	if !evaluated.Failed() || evaluated.Error() == nil || evaluated.FailureCategory() != CommandFailure {
+		t.Fatalf("A successful command should be failed by failed_when: %+v\n", evaluated)
+	}
+
+	timedOut := localResult{err: fmt.Errorf("timed out"), category: TimeoutFailure}
+	evaluated = evaluateResult(CommandTask{FailedWhen: Conditions{"false"}}, map[string]interface{}{}, timedOut)
+	if evaluated.Failed() || evaluated.FailureCategory() != NoFailure {
+		t.Fatalf("failed_when should override a command timeout: %+v\n", evaluated)
+	}
+
+	unreachable := localResult{err: fmt.Errorf("no route to host"), category: ConnectionFailure}
+	evaluated = evaluateResult(CommandTask{FailedWhen: Conditions{"false"}}, map[string]interface{}{}, unreachable)
+	if !evaluated.Failed() || evaluated.FailureCategory() != ConnectionFailure {
+		t.Fatalf("failed_when shouldn't override a connection failure: %+v\n", evaluated)
+	}
+}
+
+func TestRunTaskWhenError(t *testing.T) {
+	task := CommandTask{Name: "broken", Cmd: "whoami", When: Conditions{"missing > 1"}}
+	executing := executingHost{Host: &Host{Vars: map[string]interface{}{}, name: "host"}, conn: &SSHConnection{}}
+	taskResult := Playbook{}.runTask(task, executing, NewVarResolver(nil))
+	if !taskResult.Failed() || taskResult.Skipped() || taskResult.FailureCategory() != CommandFailure {
+		t.Fatalf("Expected a when which can't be evaluated to be a command failure, got %+v\n", taskResult)
+	}
+	if failure := registeredResult(taskResult)["failure"]; failure != "command" {
+		t.Fatalf("Expected the registered failure to be command, got %q\n", failure)
+	}
+}
+
+func TestPlaybookExecuteReportsAuthFailure(t *testing.T) {
+	inventory := Inventory{
+		All: HostGroup{
+			Hosts: map[string]Host{"nouser": {}},
+		},
+	}
+	playbook := createTestPlaybook(t, shortPlaybookContents)
+
+	playbookResults := playbook.Execute(inventory)
+	taskResult, keyExists := playbookResults["task one"]["nouser"]
+	if !keyExists {
+		t.Fatalf("Expected a result for the host which couldn't connect: %v\n", playbookResults)
+	}
+	if taskResult.FailureCategory() != AuthFailure || !taskResult.Failed() {
+		t.Fatalf("Expected an auth failure, got: %+v\n", taskResult)
+	}
+}
+
+var failingPlaybookContents = []byte(`
+name: Failing Playbook
+hosts:
+  - all
+tasks:
+  - name: task one
+    cmd: whoami
+    when: not skip
+  - name: task two
+    cmd: whoami
+    when: not skip
+`)
+
+func failingInventory() Inventory {
+	return Inventory{
+		All: HostGroup{
+			Hosts: map[string]Host{
+				"nouser": {Vars: map[string]interface{}{"skip": false}},
+				"skips":  {Vars: map[string]interface{}{"skip": true}},
+			},
+		},
+	}
+}
+
+func TestPlaybookExecuteRemovesFailedHosts(t *testing.T) {
+	playbook := createTestPlaybook(t, failingPlaybookContents)
+
+	playbookResults := playbook.Execute(failingInventory())
+	if _, keyExists := playbookResults["task one"]["nouser"]; !keyExists {
+		t.Fatalf("Expected a failed result for task one: %v\n", playbookResults)
+	}
+	if _, keyExists := playbookResults["task two"]["nouser"]; keyExists {
+		t.Fatalf("A failed host shouldn't run later tasks: %v\n", playbookResults)
+	}
+	if _, keyExists := playbookResults["task two"]["skips"]; !keyExists {
+		t.Fatalf("A healthy host should carry on with the play: %v\n", playbookResults)
+	}
+}
+
+func TestPlaybookExecuteAbortsOnFailureThresholds(t *testing.T) {
+	fortyPercent := 40.0
+	sixtyPercent := 60.0
+	cases := []struct {
+		anyErrorsFatal    bool
+		maxFailPercentage *float64
+		aborted           bool
+	}{
+		{anyErrorsFatal: true, aborted: true},
+		{maxFailPercentage: &fortyPercent, aborted: true},
+		{maxFailPercentage: &sixtyPercent, aborted: false},
+	}
+	for _, c := range cases {
+		playbook := createTestPlaybook(t, failingPlaybookContents)
+		playbook.AnyErrorsFatal = c.anyErrorsFatal
+		playbook.MaxFailPercentage = c.maxFailPercentage
+
+		playbookResults := playbook.Execute(failingInventory())
+		_, ranTaskTwo := playbookResults["task two"]["skips"]
+		if ranTaskTwo == c.aborted {
+			t.Fatalf("Expected aborted to be %v for %+v: %v\n", c.aborted, c, playbookResults)
+		}
+	}
+}
+
+var ignoredErrorsPlaybookContents = []byte(`
+name: Ignored Errors Playbook
+hosts:
+  - all
+tasks:
+  - name: task one
+    cmd: echo {{ .undefined }}
+    ignore_errors: true
+  - name: task two
+    cmd: whoami
+    when: false
+`)
+
+func TestPlaybookExecuteIgnoreErrors(t *testing.T) {
+	playbook := createTestPlaybook(t, ignoredErrorsPlaybookContents)
+
+	playbookResults := playbook.Execute(failingInventory())
+	taskResult := playbookResults["task one"]["nouser"]
+	if taskResult == nil || !taskResult.Failed() {
+		t.Fatalf("Expected task one to fail: %v\n", playbookResults)
+	}
+	if _, keyExists := playbookResults["task two"]["nouser"]; !keyExists {
+		t.Fatalf("An ignored failure shouldn't remove the host: %v\n", playbookResults)
+	}
+}
+
+func TestPlayRunIgnoreErrorsCategories(t *testing.T) {
+	for category, ignored := range map[int]bool{
+		CommandFailure:    true,
+		TimeoutFailure:    true,
+		ConnectionFailure: false,
+		AuthFailure:       false,
+	} {
+		run, _ := fakePlayRun(1, 1, 0)
+		task := CommandTask{Name: "task", IgnoreErrors: true}
+		run.result[task.Name] = make(map[string]TaskResult)
+		run.record(task, run.hosts[0], localResult{err: fmt.Errorf("failed"), category: category})
+		if run.failed[run.hosts[0].name] == ignored {
+			t.Fatalf("Expected ignore_errors to ignore a %v failure to be %v\n", failureCategoryNames[category], ignored)
+		}
+	}
+}
+
+// fakeConnection runs commands without a host, tracking how many run at once
+type fakeConnection struct {
+	connected bool
+	running   *int32
+	maxSeen   *int32
+	delay     time.Duration
+	hostname  string
+	// Called once each command has finished, when set
+	finished func(hostname, command string)
+}
+
+func (f *fakeConnection) Connect(host *Host) error {
+	f.connected = true
+	f.hostname = host.name
+	return nil
+}
+
+func (f *fakeConnection) Run(command string, options RunOptions) TaskResult {
+	running := atomic.AddInt32(f.running, 1)
+	for {
+		seen := atomic.LoadInt32(f.maxSeen)
+		if running <= seen || atomic.CompareAndSwapInt32(f.maxSeen, seen, running) {
+			break
+		}
+	}
+	time.Sleep(f.delay)
+	atomic.AddInt32(f.running, -1)
+	if f.finished != nil {
+		f.finished(f.hostname, command)
+	}
+	return localResult{}
+}
+
+func (f *fakeConnection) Status() int {
+	if f.connected {
+		return SuccessfulConnection
+	}
+	return NotInitiatedConnection
+}
+
+func (f *fakeConnection) SetConnectionError(err error) {}
+
+func (f *fakeConnection) Close() error {
+	f.connected = false
+	return nil
+}
+
+func fakePlayRun(hostCount, forks int, delay time.Duration) (*playRun, *int32) {
+	hosts := make([]*Host, hostCount)
+	for index := range hosts {
+		hosts[index] = &Host{
+			Vars: map[string]interface{}{},
+			name: fmt.Sprintf("host%02d", index),
+		}
+	}
+	run := newPlayRun(Playbook{}, hosts, NewVarResolver(nil), make(PlaybookResult, 0), ExecuteOptions{Forks: forks}, newHostConnections(ExecuteOptions{}))
+	var running, maxSeen int32
+	for _, host := range hosts {
+		run.executing[host.name] = executingHost{
+			Host: host,
+			conn: &fakeConnection{running: &running, maxSeen: &maxSeen, delay: delay},
+		}
+	}
+	return run, &maxSeen
+}
+
+func TestRunTaskOnHostsBoundedByForks(t *testing.T) {
+	run, maxSeen := fakePlayRun(10, 3, 20*time.Millisecond)
+	results := run.runTaskOnHosts(CommandTask{Name: "task", Cmd: "whoami"}, run.hosts)
+	if len(results) != len(run.hosts) {
+		t.Fatalf("Expected a result for every host, got %v\n", len(results))
+	}
+	for index, taskResult := range results {
+		if taskResult == nil {
+			t.Fatalf("Missing result for host %v\n", run.hosts[index].name)
+		}
+	}
+	if *maxSeen != 3 {
+		t.Fatalf("Expected 3 hosts to run at once, saw %v\n", *maxSeen)
+	}
+
+	run, maxSeen = fakePlayRun(4, 1, time.Millisecond)
+	run.runTaskOnHosts(CommandTask{Name: "task", Cmd: "whoami"}, run.hosts)
+	if *maxSeen != 1 {
+		t.Fatalf("A single fork should run hosts one at a time, saw %v\n", *maxSeen)
+	}
+}
+
+func TestFreeStrategyDoesNotWaitForSlowHosts(t *testing.T) {
+	run, _ := fakePlayRun(2, 2, time.Millisecond)
+	run.play.Tasks = []CommandTask{
+		{Name: "one", Cmd: "one"},
+		{Name: "two", Cmd: "two"},
+		{Name: "three", Cmd: "three"},
+	}
+	var mutex sync.Mutex
+	order := make([]string, 0)
+	for _, executing := range run.executing {
+		conn := executing.conn.(*fakeConnection)
+		conn.finished = func(hostname, command string) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			order = append(order, hostname+":"+command)
+		}
+	}
+	run.executing["host00"].conn.(*fakeConnection).delay = 100 * time.Millisecond
+
+	strategyByName(FreeStrategy).run(run)
+	finished := strings.Join(order, ",")
+	expected := "host01:one,host01:two,host01:three,host00:one,host00:two,host00:three"
+	if finished != expected {
+		t.Fatalf("Expected the fast host to finish first, got %v\n", finished)
+	}
+	for _, task := range run.play.Tasks {
+		if len(run.result[task.Name]) != 2 {
+			t.Fatalf("Expected results for both hosts for %v, got %v\n", task.Name, run.result[task.Name])
+		}
+	}
+
+	run, _ = fakePlayRun(2, 2, time.Millisecond)
+	run.play.Tasks = []CommandTask{{Name: "one", Cmd: "one"}, {Name: "two", Cmd: "two"}}
+	order = make([]string, 0)
+	for _, executing := range run.executing {
+		conn := executing.conn.(*fakeConnection)
+		conn.finished = func(hostname, command string) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			order = append(order, hostname+":"+command)
+		}
+	}
+	run.executing["host00"].conn.(*fakeConnection).delay = 100 * time.Millisecond
+	strategyByName(LinearStrategy).run(run)
+	if order[1] != "host00:one" {
+		t.Fatalf("Linear strategy should wait for every host before the next task, got %v\n", order)
+	}
+}
+
+func TestPlaybookUnknownStrategy(t *testing.T) {
+	_, err := playbookFromContents([]byte(`
+name: bad strategy
+hosts: [all]
+strategy: random
+tasks:
+  - name: task one
+    cmd: whoami
+`))
+	if err == nil || !strings.Contains(err.Error(), "strategy") {
+		t.Fatalf("Expected an error for an unknown strategy, got %v\n", err)
+	}
+}
+
+func TestSerialBatches(t *testing.T) {
+	hosts := make([]*Host, 10)
+	for index := range hosts {
+		hosts[index] = &Host{name: fmt.Sprintf("host%02d", index)}
+	}
+	cases := []struct {
+		serial   Serial
+		expected []int
+	}{
+		{nil, []int{10}},
+		{Serial{"3"}, []int{3, 3, 3, 1}},
+		{Serial{"25%"}, []int{2, 2, 2, 2, 2}},
+		{Serial{"1", "10%", "50%"}, []int{1, 1, 5, 3}},
+		{Serial{"1%"}, []int{1, 1, 1, 1, 1, 1, 1, 1, 1, 1}},
+	}
+	for _, c := range cases {
+		batches, err := c.serial.batches(hosts)
+		if err != nil {
+			t.Fatalf("Received error batching with serial %v: %v\n", c.serial, err)
+		}
+		sizes := make([]int, len(batches))
+		for index, batch := range batches {
+			sizes[index] = len(batch)
+		}
+		if fmt.Sprint(sizes) != fmt.Sprint(c.expected) {
+			t.Fatalf("Serial %v gave batches %v, expected %v\n", c.serial, sizes, c.expected)
+		}
+	}
+}
+
+func TestPlaybookSerial(t *testing.T) {
+	playbook, err := playbookFromContents([]byte(`
+name: rolling
+hosts: [all]
+serial: [1, "50%"]
+tasks:
+  - name: task one
+    cmd: whoami
+`))
+	if err != nil {
+		t.Fatalf("Received error loading playbook with serial: %v\n", err)
+	}
+	if fmt.Sprint(playbook.Serial) != "[1 50%]" {
+		t.Fatalf("Serial wasn't loaded, got %v\n", playbook.Serial)
+	}
+	for _, serial := range []string{"0", "150%", "many"} {
+		_, err := playbookFromContents([]byte("name: bad\nhosts: [all]\nserial: " + serial + "\ntasks: []\n"))
+		if err == nil {
+			t.Fatalf("Expected an error for serial %v\n", serial)
+		}
+	}
+}
+
+func TestPlaybookSerialAbortsLaterBatches(t *testing.T) {
+	zeroPercent := 0.0
+	playbook := createTestPlaybook(t, failingPlaybookContents)
+	playbook.Serial = Serial{"1"}
+	playbook.Order = ReverseSortedOrder
+	playbookResults := playbook.Execute(failingInventory())
+	if _, keyExists := playbookResults["task one"]["nouser"]; !keyExists {
+		t.Fatalf("A healthy batch shouldn't stop the next: %v\n", playbookResults)
+	}
+
+	// A batch in which every host failed stops the rest without a threshold
+	playbook.Order = SortedOrder
+	playbookResults = playbook.Execute(failingInventory())
+	if _, keyExists := playbookResults["task one"]["skips"]; keyExists {
+		t.Fatalf("A batch where every host failed should stop the next: %v\n", playbookResults)
+	}
+
+	playbook.MaxFailPercentage = &zeroPercent
+	playbookResults = playbook.Execute(failingInventory())
+	if _, keyExists := playbookResults["task one"]["nouser"]; !keyExists {
+		t.Fatalf("Expected the first batch to run: %v\n", playbookResults)
+	}
+	if _, keyExists := playbookResults["task one"]["skips"]; keyExists {
+		t.Fatalf("A batch over the threshold should stop the next: %v\n", playbookResults)
+	}
+}
+
+func TestPlaybookTaskTimeout(t *testing.T) {
+	playbook, err := playbookFromContents([]byte(`
+name: timeouts
+hosts: [all]
+tasks:
+  - name: bounded
+    cmd: sleep 1
+    timeout: 30
+  - name: invalid
+    cmd: sleep 1
+    timeout: "{{ .when }}"
+    vars:
+      when: soon
+`))
+	if err != nil {
+		t.Fatalf("Received error loading playbook with timeouts: %v\n", err)
+	}
+	if playbook.Tasks[0].Timeout != "30" {
+		t.Fatalf("Expected the timeout to be loaded, got %v\n", playbook.Tasks[0].Timeout)
+	}
+	executing := executingHost{Host: &Host{Vars: map[string]interface{}{}, name: "host"}, conn: &SSHConnection{}}
+	taskResult := playbook.runTask(playbook.Tasks[1], executing, NewVarResolver(nil))
+	if taskResult.Error() == nil || !strings.Contains(taskResult.Error().Error(), "Invalid timeout") {
+		t.Fatalf("Expected an invalid timeout error, got %v\n", taskResult.Error())
+	}
+	if executing.conn.Status() != NotInitiatedConnection {
+		t.Fatalf("An invalid task shouldn't connect to the host\n")
+	}
+}
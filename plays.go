@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Plays are every play in a playbook file. A file is either a single play,
+// or a list of them which run one after another, e.g.
+//
+//	# site.yaml
+//	- name: web servers
+//	  hosts: [web]
+//	  tasks: ...
+//	- name: databases
+//	  hosts: [db]
+//	  tasks: ...
+//
+// Variables registered by a play are visible to the plays after it, and a
+// host which fails is left out of the plays after it. A play which is aborted
+// stops the rest of the plays from running.
+type Plays []Playbook
+
+// PlayResult is the results of a single play, keyed by task then host like a
+// PlaybookResult
+type PlayResult struct {
+	Name    string
+	Results PlaybookResult
+}
+
+// RunResult is the combined result of every play which ran, in order
+type RunResult struct {
+	Plays []PlayResult
+}
+
+// HostRecap counts the results of every task a host ran across the plays. A
+// task which changed the host is counted as both ok and changed
+type HostRecap struct {
+	Ok          int
+	Changed     int
+	Unreachable int
+	Failed      int
+	Skipped     int
+}
+
+func PlaysFromFilepath(filepath string) (Plays, error) {
+	contents, err := os.ReadFile(filepath)
+	if err != nil {
+		return nil, err
+	}
+	plays, err := playsFromContents(contents)
+	if err != nil {
+		return nil, err
+	}
+	for index := range plays {
+		plays[index].baseDir = playbookDir(filepath)
+	}
+	return plays, nil
+}
+
+func playsFromContents(contents []byte) (Plays, error) {
+	var document yaml.Node
+	if err := yaml.Unmarshal(contents, &document); err != nil {
+		return nil, err
+	}
+	if len(document.Content) <= 0 {
+		return nil, fmt.Errorf("Playbook is empty")
+	}
+	nodes := []*yaml.Node{document.Content[0]}
+	if document.Content[0].Kind == yaml.SequenceNode {
+		nodes = document.Content[0].Content
+	}
+	plays := make(Plays, 0, len(nodes))
+	for index, node := range nodes {
+		playbook := newPlaybook()
+		if err := node.Decode(&playbook); err != nil {
+			return nil, fmt.Errorf("Error reading play %v: %v", index+1, err)
+		}
+		if err := playbook.validate(); err != nil {
+			return nil, fmt.Errorf("Error reading play %v: %v", index+1, err)
+		}
+		plays = append(plays, playbook)
+	}
+	return plays, nil
+}
+
+func (p Plays) Execute(inventory Inventory) RunResult {
+	return p.ExecuteWithOptions(inventory, ExecuteOptions{})
+}
+
+func (p Plays) ExecuteWithOptions(inventory Inventory, options ExecuteOptions) RunResult {
+	resolver := NewVarResolver(options.ExtraVars)
+	connections := newHostConnections(options)
+	defer connections.closeAll()
+	failed := make(map[string]bool, 0)
+	runResult := RunResult{Plays: make([]PlayResult, 0, len(p))}
+	for _, play := range p {
+		result, aborted := play.execute(inventory, options, resolver, connections, failed)
+		runResult.Plays = append(runResult.Plays, PlayResult{Name: play.Name, Results: result})
+		if aborted {
+			break
+		}
+	}
+	return runResult
+}
+
+// Recap counts every host's results across the plays, keyed by hostname
+func (r RunResult) Recap() map[string]*HostRecap {
+	recap := make(map[string]*HostRecap, 0)
+	for _, play := range r.Plays {
+		for _, hostResults := range play.Results {
+			for hostname, taskResult := range hostResults {
+				if _, exists := recap[hostname]; !exists {
+					recap[hostname] = &HostRecap{}
+				}
+				recap[hostname].count(taskResult)
+			}
+		}
+	}
+	return recap
+}
+
+func (h *HostRecap) count(taskResult TaskResult) {
+	switch {
+	case taskResult.Skipped():
+		h.Skipped++
+	case taskResult.FailureCategory() == ConnectionFailure || taskResult.FailureCategory() == AuthFailure:
+		h.Unreachable++
+	case taskResult.Failed():
+		h.Failed++
+	default:
+		h.Ok++
+		if taskResult.Changed() {
+			h.Changed++
+		}
+	}
+}
+
+// FormatRecap returns a line per host summarising its results, sorted by
+// hostname
+func FormatRecap(recap map[string]*HostRecap) string {
+	hostnames := make([]string, 0, len(recap))
+	for hostname := range recap {
+		hostnames = append(hostnames, hostname)
+	}
+	sort.Strings(hostnames)
+
+	var sb strings.Builder
+	sb.WriteString("recap:\n")
+	for _, hostname := range hostnames {
+		counts := recap[hostname]
+		sb.WriteString(fmt.Sprintf("\t%v: ok=%v changed=%v unreachable=%v failed=%v skipped=%v\n",
+			hostname, counts.Ok, counts.Changed, counts.Unreachable, counts.Failed, counts.Skipped))
+	}
+	return sb.String()
+}
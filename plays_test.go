@@ -0,0 +1,161 @@
+package main
+
+import (
+	"golang.org/x/crypto/ssh"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+var multiplePlaysContents = []byte(`
+- name: first play
+  hosts: [all]
+  tasks:
+    - name: never runs
+      cmd: whoami
+      when: false
+      register: first
+    - name: fails without a user
+      cmd: whoami
+      when: not skip
+- name: second play
+  hosts: [all]
+  tasks:
+    - name: sees the first play
+      cmd: whoami
+      when: not first.skipped
+`)
+
+func TestPlaysFromContents(t *testing.T) {
+	plays, err := playsFromContents(multiplePlaysContents)
+	if err != nil {
+		t.Fatalf("Received error reading multiple plays: %v\n", err)
+	}
+	if len(plays) != 2 || plays[0].Name != "first play" || plays[1].Name != "second play" {
+		t.Fatalf("Expected both plays in order, got %+v\n", plays)
+	}
+
+	plays, err = playsFromContents(shortPlaybookContents)
+	if err != nil {
+		t.Fatalf("Received error reading a single play: %v\n", err)
+	}
+	if len(plays) != 1 || plays[0].Name != "Short Playbook" {
+		t.Fatalf("Expected the single play, got %+v\n", plays)
+	}
+
+	_, err = playsFromContents([]byte("- name: bad\n  hosts: [all]\n  strategy: random\n"))
+	if err == nil || !strings.Contains(err.Error(), "play 1") {
+		t.Fatalf("Expected an error naming the invalid play, got %v\n", err)
+	}
+}
+
+func TestPlaysExecute(t *testing.T) {
+	plays, err := playsFromContents(multiplePlaysContents)
+	if err != nil {
+		t.Fatalf("Received error reading multiple plays: %v\n", err)
+	}
+	runResult := plays.Execute(failingInventory())
+	if len(runResult.Plays) != 2 {
+		t.Fatalf("Expected results for both plays, got %+v\n", runResult)
+	}
+
+	second := runResult.Plays[1].Results["sees the first play"]
+	if _, keyExists := second["nouser"]; keyExists {
+		t.Fatalf("A host which failed in the first play shouldn't run the second: %v\n", second)
+	}
+	taskResult, keyExists := second["skips"]
+	if !keyExists || taskResult.Error() != nil || !taskResult.Skipped() {
+		t.Fatalf("Variables registered in the first play should be visible to the second: %v\n", second)
+	}
+
+	recap := runResult.Recap()
+	if *recap["nouser"] != (HostRecap{Unreachable: 1, Skipped: 1}) {
+		t.Fatalf("Unexpected recap for nouser: %+v\n", *recap["nouser"])
+	}
+	if *recap["skips"] != (HostRecap{Skipped: 3}) {
+		t.Fatalf("Unexpected recap for skips: %+v\n", *recap["skips"])
+	}
+	formatted := FormatRecap(recap)
+	if !strings.Contains(formatted, "\tnouser: ok=0 changed=0 unreachable=1 failed=0 skipped=1\n") {
+		t.Fatalf("Unexpected formatted recap: %v\n", formatted)
+	}
+}
+
+func TestPlaysReuseConnections(t *testing.T) {
+	t.Setenv("SSH_AUTH_SOCK", "")
+	port, connections := countingServer(t)
+	hosts := make(map[string]Host, 0)
+	for _, name := range []string{"web1", "web2"} {
+		hosts[name] = Host{Vars: map[string]interface{}{
+			"address":           "127.0.0.1",
+			"port":              port,
+			"username":          "deploy",
+			"password":          "secret",
+			"host_key_checking": "off",
+		}}
+	}
+	plays, err := playsFromContents([]byte(`
+- name: first play
+  hosts: [all]
+  serial: 1
+  tasks:
+    - name: one
+      cmd: "true"
+- name: second play
+  hosts: [all]
+  tasks:
+    - name: two
+      cmd: "true"
+`))
+	if err != nil {
+		t.Fatalf("Received error reading plays: %v\n", err)
+	}
+	runResult := plays.Execute(Inventory{All: HostGroup{Hosts: hosts}})
+	for _, play := range runResult.Plays {
+		for taskName, hostResults := range play.Results {
+			for hostname, taskResult := range hostResults {
+				if taskResult.Error() != nil {
+					t.Fatalf("Task %v failed on %v: %v\n", taskName, hostname, taskResult.Error())
+				}
+			}
+		}
+	}
+	if count := atomic.LoadInt32(connections); count != 2 {
+		t.Fatalf("Expected each host to be connected to once across plays and batches, got %v connections\n", count)
+	}
+}
+
+func TestHostConnectionsCloseAll(t *testing.T) {
+	connections := newHostConnections(ExecuteOptions{})
+	if connections.get("web1") != connections.get("web1") {
+		t.Fatalf("Expected the same connection for a host every time\n")
+	}
+	fake := &fakeConnection{connected: true}
+	connections.byHost["web2"] = fake
+
+	t.Setenv("SSH_AUTH_SOCK", "")
+	bastionPort, _ := countingServer(t)
+	targetPort, _ := countingServer(t)
+	err := connections.get("web3").Connect(testHost(map[string]interface{}{
+		"username":          "deploy",
+		"password":          "secret",
+		"port":              targetPort,
+		"host_key_checking": "off",
+		"proxy_jump":        "jump@127.0.0.1:" + bastionPort,
+	}))
+	if err != nil {
+		t.Fatalf("Expected to connect through the jump host: %v\n", err)
+	}
+	var bastion *ssh.Client
+	for _, shared := range connections.jumps.byChain {
+		bastion = shared.client
+	}
+
+	connections.closeAll()
+	if fake.connected || len(connections.byHost) != 0 {
+		t.Fatalf("Expected every connection to be closed\n")
+	}
+	if _, _, err := bastion.SendRequest("keepalive@openssh.com", true, nil); err == nil || len(connections.jumps.byChain) != 0 {
+		t.Fatalf("Expected the jump host connection to be closed\n")
+	}
+}
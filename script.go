@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// ScriptModule uploads a local script to a temporary directory on the host,
+// runs it and removes it again. Its result is the same as a cmd's, so
+// register, failed_when, timeout and become all work the same way. e.g.
+//
+//	tasks:
+//	  - name: migrate
+//	    script:
+//	      src: scripts/migrate.py
+//	      args: ["--env", "{{ .env }}"]
+//	      interpreter: python3
+type ScriptModule struct {
+	// Local script, relative to the playbook's directory
+	Src string `yaml:"src"`
+	// Arguments passed to the script, each is quoted
+	Args []string `yaml:"args,omitempty"`
+	// Command the script is run with, e.g. bash or python3. Without one the
+	// script is executed directly and needs a #! line
+	Interpreter string `yaml:"interpreter,omitempty"`
+}
+
+func (s ScriptModule) validate() error {
+	if s.Src == "" {
+		return errors.New("script needs a src")
+	}
+	return nil
+}
+
+// command is how the uploaded script at remotePath is run
+func (s ScriptModule) command(remotePath string) string {
+	words := make([]string, 0, len(s.Args)+2)
+	if s.Interpreter != "" {
+		words = append(words, s.Interpreter)
+	}
+	words = append(words, quoteFilter(remotePath))
+	for _, arg := range s.Args {
+		words = append(words, quoteFilter(arg))
+	}
+	return strings.Join(words, " ")
+}
+
+// runScript runs a script task, baseDir is the directory a relative src is
+// in
+func runScript(module ScriptModule, baseDir string, conn Connection, options RunOptions) TaskResult {
+	start := time.Now()
+	if err := module.validate(); err != nil {
+		return fileTaskError(err, start)
+	}
+	src, err := localPath(baseDir, module.Src)
+	if err != nil {
+		return fileTaskError(err, start)
+	}
+	script, err := os.Open(src)
+	if err != nil {
+		return fileTaskError(err, start)
+	}
+	defer script.Close()
+
+	// The script is staged in a private directory, which a become user other
+	// than root is given access to, see uploadStage
+	stage := newUploadStage(conn, options)
+	defer stage.remove()
+	remotePath, err := stage.upload(script, "", 0700)
+	if err != nil {
+		return fileTaskError(fmt.Errorf("Unable to upload %v: %v", module.Src, err), start)
+	}
+	if err := stage.share(); err != nil {
+		return fileTaskError(err, start)
+	}
+	return conn.Run(module.command(remotePath), options)
+}
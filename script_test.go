@@ -0,0 +1,91 @@
+package main
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestScriptCommand(t *testing.T) {
+	module := ScriptModule{Src: "setup.sh", Args: []string{"--name", "it's"}, Interpreter: "bash"}
+	expected := `bash '/tmp/x/setup.sh' '--name' 'it'"'"'s'`
+	if command := module.command("/tmp/x/setup.sh"); command != expected {
+		t.Fatalf("Expected command %v, got %v\n", expected, command)
+	}
+	if _, err := playbookFromContents([]byte("hosts: [all]\ntasks:\n  - script: {args: [one]}\n")); err == nil {
+		t.Fatalf("Expected a script without a src to be an error\n")
+	}
+}
+
+func TestSSHScript(t *testing.T) {
+	conn := connectToTestServer(t)
+	local := t.TempDir()
+	scripts := map[string]string{
+		"greet.sh": "#!/bin/sh\necho \"hello $1 $2\"\necho \"from $(dirname \"$0\")\" >&2\n",
+		"fail.sh":  "#!/bin/sh\necho failing\nexit 3\n",
+		"plain":    "echo \"interpreted $#\"\n",
+	}
+	for name, script := range scripts {
+		if err := os.WriteFile(filepath.Join(local, name), []byte(script), 0644); err != nil {
+			t.Fatalf("Unable to write script: %v\n", err)
+		}
+	}
+	before, _ := filepath.Glob("/tmp/.goat-script-*")
+
+	result := runScript(ScriptModule{Src: "greet.sh", Args: []string{"big", "world"}}, local, conn, RunOptions{})
+	if result.Error() != nil || result.Stdout() != "hello big world\n" {
+		t.Fatalf("Expected the script's output, got %q %v\n", result.Stdout(), result.Error())
+	}
+	if registered := registeredResult(result); registered["rc"] != 0 || registered["stderr"] == "" {
+		t.Fatalf("Expected a command's result, got %v\n", registered)
+	}
+
+	result = runScript(ScriptModule{Src: "fail.sh"}, local, conn, RunOptions{})
+	if result.FailureCategory() != CommandFailure || result.ExitCode() != 3 || result.Stdout() != "failing\n" {
+		t.Fatalf("Expected the script to fail with its exit code, got %v %v\n", result.ExitCode(), result.Error())
+	}
+
+	result = runScript(ScriptModule{Src: "plain", Args: []string{"a b"}, Interpreter: "sh"}, local, conn, RunOptions{})
+	if result.Error() != nil || result.Stdout() != "interpreted 1\n" {
+		t.Fatalf("Expected the interpreter to run the script, got %q %v\n", result.Stdout(), result.Error())
+	}
+
+	result = runScript(ScriptModule{Src: "missing.sh"}, local, conn, RunOptions{})
+	if result.Error() == nil {
+		t.Fatalf("Expected a missing script to fail\n")
+	}
+
+	if after, _ := filepath.Glob("/tmp/.goat-script-*"); len(after) != len(before) {
+		t.Fatalf("Expected the scripts to be removed, found %v\n", after)
+	}
+}
+
+func TestSSHScriptBecome(t *testing.T) {
+	installFakeBecome(t)
+	conn := connectToTestServer(t)
+	local := t.TempDir()
+	if err := os.WriteFile(filepath.Join(local, "id.sh"), []byte("#!/bin/sh\necho became\n"), 0644); err != nil {
+		t.Fatalf("Unable to write script: %v\n", err)
+	}
+	options := RunOptions{Become: &Become{User: "root", Method: SudoBecome, Password: "correct"}}
+	result := runScript(ScriptModule{Src: "id.sh"}, local, conn, options)
+	if result.Error() != nil || result.Stdout() != "became\n" {
+		t.Fatalf("Expected the script to run with become, got %q %v\n", result.Stdout(), result.Error())
+	}
+
+	// Only the become user is let in to a script for anyone but root
+	if err := os.WriteFile(filepath.Join(local, "modes.sh"), []byte("#!/bin/sh\nstat -c %a \"$0\" \"$(dirname \"$0\")\"\necho \"$0\"\n"), 0644); err != nil {
+		t.Fatalf("Unable to write script: %v\n", err)
+	}
+	options.Become.User = "nobody"
+	result = runScript(ScriptModule{Src: "modes.sh"}, local, conn, options)
+	lines := strings.Split(strings.TrimSpace(result.Stdout()), "\n")
+	if result.Error() != nil || len(lines) != 3 || lines[0] != "700" || lines[1] != "700" {
+		t.Fatalf("Expected a private script and directory, got %q %v\n", result.Stdout(), result.Error())
+	}
+	if _, err := os.Stat(path.Dir(lines[2])); err == nil {
+		t.Fatalf("Expected the script's directory to be removed\n")
+	}
+}
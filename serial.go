@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Serial splits a play's hosts into batches which run the whole task list one
+// after another, so only part of a pool is ever being changed at once. Each
+// batch size is a count of hosts or a percentage of the play's hosts, e.g.
+//
+//	serial: 2
+//	serial: 25%
+//	serial: [1, 10%, 50%]
+//
+// A list gives escalating batch sizes, the last of which is repeated until
+// every host has run. A batch which goes over the play's failure threshold,
+// or in which every host failed, stops the batches after it from running.
+type Serial []string
+
+func (s *Serial) UnmarshalYAML(value *yaml.Node) error {
+	nodes := []*yaml.Node{value}
+	if value.Kind == yaml.SequenceNode {
+		nodes = value.Content
+	}
+	sizes := make(Serial, len(nodes))
+	for index, node := range nodes {
+		// Sizes are written as numbers or percentages, keep them as written
+		if node.Kind != yaml.ScalarNode {
+			return fmt.Errorf("serial should be a batch size or a list of them, line %v", node.Line)
+		}
+		sizes[index] = node.Value
+	}
+	*s = sizes
+	return nil
+}
+
+// validate checks every batch size can be parsed
+func (s Serial) validate() error {
+	for _, size := range s {
+		if _, err := batchSize(size, 1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// batches splits hosts into the batches they run in, without serial there's
+// a single batch of every host
+func (s Serial) batches(hosts []*Host) ([][]*Host, error) {
+	if len(s) <= 0 {
+		return [][]*Host{hosts}, nil
+	}
+	batches := make([][]*Host, 0)
+	for start, index := 0, 0; start < len(hosts); index++ {
+		sizeIndex := index
+		if sizeIndex >= len(s) {
+			sizeIndex = len(s) - 1
+		}
+		size, err := batchSize(s[sizeIndex], len(hosts))
+		if err != nil {
+			return nil, err
+		}
+		end := start + size
+		if end > len(hosts) {
+			end = len(hosts)
+		}
+		batches = append(batches, hosts[start:end])
+		start = end
+	}
+	return batches, nil
+}
+
+// batchSize parses a single batch size, a percentage is of total and is
+// rounded down but always at least one host
+func batchSize(size string, total int) (int, error) {
+	size = strings.TrimSpace(size)
+	if strings.HasSuffix(size, "%") {
+		value, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimSuffix(size, "%")), 64)
+		if err != nil || value <= 0 || value > 100 {
+			return 0, fmt.Errorf("serial percentage should be between 0 and 100%%, got: %v", size)
+		}
+		count := int(math.Floor(value * float64(total) / 100))
+		if count < 1 {
+			count = 1
+		}
+		return count, nil
+	}
+	count, err := strconv.Atoi(size)
+	if err != nil || count < 1 {
+		return 0, fmt.Errorf("serial should be a positive number of hosts or a percentage, got: %v", size)
+	}
+	return count, nil
+}
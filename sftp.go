@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"github.com/pkg/sftp"
+	"io"
+	"os"
+)
+
+// sftp returns the connection's SFTP client, starting the subsystem on its
+// SSH client the first time it's needed
+func (s *SSHConnection) sftp() (*sftp.Client, error) {
+	if s.sftpClient != nil {
+		return s.sftpClient, nil
+	}
+	if s.Status() != SuccessfulConnection {
+		return nil, fmt.Errorf("Connection not initiated")
+	}
+	client, err := sftp.NewClient(s.Client)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to start sftp: %v", err)
+	}
+	s.sftpClient = client
+	return client, nil
+}
+
+// Upload writes content to path over SFTP. The mode is set before anything is
+// written, so the content is never readable with looser permissions
+func (s *SSHConnection) Upload(content io.Reader, path string, mode os.FileMode) error {
+	client, err := s.sftp()
+	if err != nil {
+		return err
+	}
+	file, err := client.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return err
+	}
+	if err := file.Chmod(mode); err != nil {
+		file.Close()
+		client.Remove(path)
+		return err
+	}
+	if _, err := io.Copy(file, content); err != nil {
+		file.Close()
+		client.Remove(path)
+		return err
+	}
+	return file.Close()
+}
+
+// Download copies the contents of path over SFTP
+func (s *SSHConnection) Download(path string, content io.Writer) error {
+	client, err := s.sftp()
+	if err != nil {
+		return err
+	}
+	file, err := client.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(content, file)
+	return err
+}
@@ -4,13 +4,62 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"net"
+	"strings"
 	"time"
+	"github.com/pkg/sftp"
 	"golang.org/x/crypto/ssh"
 )
 
+// ConnectionError is returned when a host can't be connected to, its category
+// tells a host which couldn't be reached apart from one which rejected goat's
+// credentials
+type ConnectionError struct {
+	category int
+	Err      error
+}
+
+func (c *ConnectionError) Error() string {
+	return c.Err.Error()
+}
+
+func (c *ConnectionError) Category() int {
+	return c.category
+}
+
+func newConnectionError(err error) *ConnectionError {
+	// Timing out connecting leaves the host unreachable, TimeoutFailure is
+	// only for commands which run too long
+	category := ConnectionFailure
+	if strings.Contains(err.Error(), "unable to authenticate") {
+		category = AuthFailure
+	}
+	return &ConnectionError{
+		category: category,
+		Err:      errors.New(fmt.Sprintf("Error when connecting to host: %v\n", err)),
+	}
+}
+
+// DefaultConnectTimeout is how long connecting to a host may take, including
+// the SSH handshake, unless the connect_timeout var says otherwise
+const DefaultConnectTimeout = 5 * time.Second
+
+// How long a command which timed out has to exit after being signalled,
+// before its session is closed
+const timeoutGrace = 2 * time.Second
+
 type SSHConnection struct {
-	Client    *ssh.Client
-	connError error
+	Client *ssh.Client
+	// Used for hosts without a connect_timeout var, DefaultConnectTimeout
+	// when zero
+	ConnectTimeout time.Duration
+	connError      error
+	// Opened by the first file transfer, see sftp.go
+	sftpClient *sftp.Client
+	// Connections to jump hosts, shared with the run's other hosts. A
+	// connection without any keeps its own, closed along with it
+	jumps    *jumpClients
+	ownJumps bool
 }
 
 func (s *SSHConnection) SetConnectionError(err error) {
@@ -27,83 +76,380 @@ func (s *SSHConnection) Status() int {
 	return FailedConnection
 }
 
-func (s *SSHConnection) Run(command string) TaskResult {
+func (s *SSHConnection) Run(command string, options RunOptions) TaskResult {
 	if status := s.Status(); status != SuccessfulConnection {
 		if status == FailedConnection {
 			return SSHCommandResult{
-				err: errors.New("Connection failed"),
+				err:      errors.New("Connection failed"),
+				category: ConnectionFailure,
 			}
 		}
 		return SSHCommandResult{
-			err: errors.New("Connection not initiated"),
+			err:      errors.New("Connection not initiated"),
+			category: ConnectionFailure,
 		}
 	}
 	session, err := s.Client.NewSession()
 	if err != nil {
 		s.connError = err
 		return SSHCommandResult{
-			err: errors.New("Unable to create session on host\n"),
+			err:      errors.New("Unable to create session on host\n"),
+			category: ConnectionFailure,
 		}
 	}
 	defer session.Close()
+	if options.Become != nil {
+		return runBecome(session, command, options.Become, options.Timeout)
+	}
 	var stdout bytes.Buffer
 	var stderr bytes.Buffer
 	session.Stdout = &stdout
 	session.Stderr = &stderr
-	err = session.Run(command)
+	start := time.Now()
+	if err := session.Start(command); err != nil {
+		return SSHCommandResult{err: err, category: ConnectionFailure, start: start, end: time.Now()}
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- session.Wait()
+	}()
 
+	category := NoFailure
+	select {
+	case err = <-done:
+		if err != nil {
+			// Anything other than the command exiting means the connection
+			// was lost, including an ExitMissingError
+			category = ConnectionFailure
+			if _, ok := err.(*ssh.ExitError); ok {
+				category = CommandFailure
+			}
+		}
+	case <-deadline(options.Timeout):
+		stopCommand(session, done)
+		err = timeoutError(options.Timeout)
+		category = TimeoutFailure
+	}
 	return SSHCommandResult{
 		stdoutBuffer: stdout,
 		stderrBuffer: stderr,
 		err:          err,
+		category:     category,
+		start:        start,
+		end:          time.Now(),
+	}
+}
+
+// deadline fires once a command has run for timeout, never when there's no
+// timeout
+func deadline(timeout time.Duration) <-chan time.Time {
+	if timeout <= 0 {
+		return nil
 	}
+	return time.After(timeout)
+}
+
+// stopCommand asks a command which has timed out to exit, closing its session
+// if it doesn't. It returns once the session's output has been written
+func stopCommand(session *ssh.Session, done <-chan error) {
+	session.Signal(ssh.SIGTERM)
+	select {
+	case <-done:
+		return
+	case <-time.After(timeoutGrace):
+	}
+	session.Close()
+	<-done
+}
+
+func timeoutError(timeout time.Duration) error {
+	return fmt.Errorf("Command timed out after %v", timeout)
 }
 
 func (s *SSHConnection) Connect(host *Host) error {
-	username, keyExists := host.Vars["username"]
-	if !keyExists {
-		return errors.New(fmt.Sprintf("Cannot connect to host %v, no username provided\n",
-			host.name))
+	host, err := withSSHConfig(host)
+	if err != nil {
+		return &ConnectionError{
+			category: ConnectionFailure,
+			Err:      errors.New(fmt.Sprintf("Error reading ssh config: %v\n", err)),
+		}
 	}
-	password, keyExists := host.Vars["password"]
+	hops, err := jumpHops(host)
+	if err != nil {
+		return &ConnectionError{
+			category: ConnectionFailure,
+			Err: errors.New(fmt.Sprintf("Cannot connect to host %v, %v\n",
+				host.name, err)),
+		}
+	}
+	var via *ssh.Client
+	if len(hops) > 0 {
+		if s.jumps == nil {
+			s.jumps, s.ownJumps = newJumpClients(), true
+		}
+		via, err = s.jumps.get(hops, s.ConnectTimeout)
+		if err != nil {
+			return err
+		}
+	}
+	client, err := dialSSH(via, host, s.ConnectTimeout)
+	if err != nil {
+		return err
+	}
+	s.Client = client
+
+	return nil
+}
+
+// Close closes the connection's SFTP client, if it has one (see sftp.go), then its SSH
+// client, then its jump hosts when they aren't shared
+func (s *SSHConnection) Close() error {
+	if s.sftpClient != nil {
+		s.sftpClient.Close()
+		s.sftpClient = nil
+	}
+	var err error
+	if s.Client != nil {
+		err = s.Client.Close()
+		s.Client = nil
+	}
+	if s.ownJumps {
+		s.jumps.closeAll()
+	}
+	return err
+}
+
+// runBecome runs command as another user, answering the escalation tool's
+// password prompt, see become.go
+func runBecome(session *ssh.Session, command string, become *Become, timeout time.Duration) TaskResult {
+	marker := becomeToken("success")
+	prompt := becomeToken("prompt") + ": "
+	wrapped, pty := becomeCommand(command, become, marker, prompt)
+	if pty {
+		if err := session.RequestPty("xterm", 40, 80, ssh.TerminalModes{ssh.ECHO: 0}); err != nil {
+			return SSHCommandResult{err: err, category: ConnectionFailure}
+		}
+	}
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		return SSHCommandResult{err: err, category: ConnectionFailure}
+	}
+	watcher := newBecomeWatcher(become, marker, prompt, pty, stdin)
+	session.Stdout = watcher.Stdout()
+	session.Stderr = watcher.Stderr()
+
+	start := time.Now()
+	if err := session.Start(wrapped); err != nil {
+		return SSHCommandResult{err: err, category: ConnectionFailure, start: start, end: time.Now()}
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- session.Wait()
+	}()
+
+	becoming := time.NewTimer(becomeTimeout)
+	defer becoming.Stop()
+	taskDeadline := deadline(timeout)
+	started := watcher.started
+	category := NoFailure
+waiting:
+	for {
+		select {
+		case err = <-done:
+			break waiting
+		case <-started:
+			// The command may read stdin itself, it gets nothing like any
+			// other command
+			becoming.Stop()
+			stdin.Close()
+			started = nil
+		case err = <-watcher.failed:
+			category = AuthFailure
+			session.Close()
+			break waiting
+		case <-becoming.C:
+			err = errBecomeTimeout
+			category = AuthFailure
+			session.Close()
+			break waiting
+		case <-taskDeadline:
+			stopCommand(session, done)
+			err = timeoutError(timeout)
+			category = TimeoutFailure
+			break waiting
+		}
+	}
+
+	if category == NoFailure {
+		select {
+		case <-watcher.started:
+			if err != nil {
+				category = ConnectionFailure
+				if _, ok := err.(*ssh.ExitError); ok {
+					category = CommandFailure
+				}
+			}
+		default:
+			err = watcher.notStarted()
+			category = AuthFailure
+		}
+	}
+	stdout, stderr := watcher.output()
+	return SSHCommandResult{
+		stdoutBuffer: stdout,
+		stderrBuffer: stderr,
+		err:          err,
+		category:     category,
+		start:        start,
+		end:          time.Now(),
+	}
+}
+
+// dialSSH connects to a host directly, or through via when it isn't nil.
+// defaultTimeout is used when the host has no connect_timeout var
+func dialSSH(via *ssh.Client, host *Host, defaultTimeout time.Duration) (*ssh.Client, error) {
+	username, keyExists := stringVar(host.Vars, "username")
 	if !keyExists {
-		return errors.New(fmt.Sprintf("Cannot connect to host %v, no password provided\n",
-			host.name))
+		return nil, &ConnectionError{
+			category: AuthFailure,
+			Err: errors.New(fmt.Sprintf("Cannot connect to host %v, no username provided\n",
+				host.name)),
+		}
+	}
+	timeout, timeoutExists, err := durationVar(host.Vars, "connect_timeout")
+	if err != nil {
+		return nil, &ConnectionError{
+			category: ConnectionFailure,
+			Err: errors.New(fmt.Sprintf("Cannot connect to host %v, %v\n",
+				host.name, err)),
+		}
+	}
+	if !timeoutExists || timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	if timeout <= 0 {
+		timeout = DefaultConnectTimeout
+	}
+	auth, err := hostAuth(host)
+	if err != nil {
+		return nil, &ConnectionError{
+			category: AuthFailure,
+			Err: errors.New(fmt.Sprintf("Cannot connect to host %v, %v\n",
+				host.name, err)),
+		}
+	}
+	defer auth.close()
+
+	uri := hostURI(host)
+	hostKeyCallback, hostKeyAlgorithms, err := hostKeyChecker(host, uri)
+	if err != nil {
+		return nil, &ConnectionError{
+			category: ConnectionFailure,
+			Err: errors.New(fmt.Sprintf("Cannot connect to host %v, %v\n",
+				host.name, err)),
+		}
 	}
 
 	config := &ssh.ClientConfig{
-		User: username,
-		Auth: []ssh.AuthMethod{
-			ssh.Password(password),
-		},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-		Timeout: time.Second * 5,
+		User:              username,
+		Auth:              auth.methods,
+		HostKeyCallback:   hostKeyCallback,
+		HostKeyAlgorithms: hostKeyAlgorithms,
+		Timeout:           timeout,
+	}
+
+	started := time.Now()
+	conn, err := dialTCP(via, uri, timeout)
+	if err != nil {
+		return nil, err
+	}
+	// The handshake can hang just like the dial, it gets what's left of the
+	// timeout
+	timer := time.AfterFunc(timeout-time.Since(started), func() {
+		conn.Close()
+	})
+	clientConn, channels, requests, err := ssh.NewClientConn(conn, uri, config)
+	if !timer.Stop() {
+		if err == nil {
+			clientConn.Close()
+		}
+		return nil, connectTimeoutError(host, timeout)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, newConnectionError(err)
+	}
+	return ssh.NewClient(clientConn, channels, requests), nil
+}
+
+// dialTCP opens a connection to uri, directly or through via
+func dialTCP(via *ssh.Client, uri string, timeout time.Duration) (net.Conn, error) {
+	if via == nil {
+		conn, err := net.DialTimeout("tcp", uri, timeout)
+		if err != nil {
+			return nil, newConnectionError(err)
+		}
+		return conn, nil
+	}
+	// Dialing through a jump host waits on the jump host's own connection
+	// to uri, which has no timeout of its own
+	type dialed struct {
+		conn net.Conn
+		err  error
+	}
+	result := make(chan dialed, 1)
+	go func() {
+		conn, err := via.Dial("tcp", uri)
+		result <- dialed{conn: conn, err: err}
+	}()
+	select {
+	case d := <-result:
+		if d.err != nil {
+			return nil, newConnectionError(d.err)
+		}
+		return d.conn, nil
+	case <-time.After(timeout):
+		go func() {
+			if d := <-result; d.conn != nil {
+				d.conn.Close()
+			}
+		}()
+		return nil, &ConnectionError{
+			category: ConnectionFailure,
+			Err:      errors.New(fmt.Sprintf("Timed out after %v connecting to %v\n", timeout, uri)),
+		}
+	}
+}
+
+func connectTimeoutError(host *Host, timeout time.Duration) error {
+	return &ConnectionError{
+		category: ConnectionFailure,
+		Err:      errors.New(fmt.Sprintf("Timed out after %v connecting to host %v\n", timeout, host.name)),
 	}
+}
+
+// hostURI is the address and port a host is connected to
+func hostURI(host *Host) string {
 	address := host.name
-	if newAddress, keyExists := host.Vars["address"]; keyExists {
+	if newAddress, keyExists := stringVar(host.Vars, "address"); keyExists {
 		address = newAddress
 	}
 
 	port := "22"
-	if specifiedPort, keyExists := host.Vars["port"]; keyExists {
+	if specifiedPort, keyExists := stringVar(host.Vars, "port"); keyExists {
 		port = specifiedPort
 	}
 
-	uri := fmt.Sprintf("%v:%v", address, port)
-
-	client, err := ssh.Dial("tcp", uri, config)
-	if err != nil {
-		return errors.New(fmt.Sprintf("Error when connecting to host: %v\n", err))
-	}
-	s.Client = client
-
-	return nil
+	return net.JoinHostPort(address, port)
 }
 
 type SSHCommandResult struct {
 	stdoutBuffer bytes.Buffer
 	stderrBuffer bytes.Buffer
 	err          error
+	category     int
+	start        time.Time
+	end          time.Time
 }
 
 func (s SSHCommandResult) StdoutBytes() []byte {
@@ -125,3 +471,47 @@ func (s SSHCommandResult) Stderr() string {
 func (s SSHCommandResult) Error() error {
 	return s.err
 }
+
+func (s SSHCommandResult) Skipped() bool {
+	return false
+}
+
+func (s SSHCommandResult) ExitCode() int {
+	if s.err == nil {
+		return 0
+	}
+	if exitErr, ok := s.err.(*ssh.ExitError); ok {
+		return exitErr.ExitStatus()
+	}
+	return -1
+}
+
+// Signal is the name of the signal which killed the remote command, if one did
+func (s SSHCommandResult) Signal() string {
+	if exitErr, ok := s.err.(*ssh.ExitError); ok {
+		return exitErr.Signal()
+	}
+	return ""
+}
+
+func (s SSHCommandResult) FailureCategory() int {
+	return s.category
+}
+
+// Changed is true for every command which ran, there's no way to know whether
+// an arbitrary command changed anything
+func (s SSHCommandResult) Changed() bool {
+	return s.err == nil
+}
+
+func (s SSHCommandResult) Failed() bool {
+	return s.err != nil
+}
+
+func (s SSHCommandResult) Start() time.Time {
+	return s.start
+}
+
+func (s SSHCommandResult) End() time.Time {
+	return s.end
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"net"
+	"os"
+	"strings"
+)
+
+// SSH authentication is configured with host vars:
+//
+//	private_key_file:       path to a private key, ~ is expanded
+//	private_key_passphrase: passphrase for an encrypted OpenSSH or PEM key
+//	password:               used for password and keyboard-interactive auth
+//	auth_methods:           the methods to try and their order
+//
+// Methods are tried in order until the host accepts one. By default that's
+// every method which is configured out of agent, key, password and
+// keyboard-interactive, in that order. The agent is used when SSH_AUTH_SOCK is
+// set. The agent's keys and the key file are offered together, at the place
+// of whichever of them comes first.
+const (
+	AgentAuth               = "agent"
+	KeyAuth                 = "key"
+	PasswordAuth            = "password"
+	KeyboardInteractiveAuth = "keyboard-interactive"
+)
+
+var defaultAuthMethods = []string{AgentAuth, KeyAuth, PasswordAuth, KeyboardInteractiveAuth}
+
+// sshAuth is the auth methods for a host, close releases the agent once the
+// connection has been authenticated
+type sshAuth struct {
+	methods []ssh.AuthMethod
+	agent   net.Conn
+	// A client only tries the publickey method once, so the agent's keys and
+	// the key file are offered by a single method in the order they appear
+	signers []func() ([]ssh.Signer, error)
+}
+
+// addSigners adds keys to the chain, the publickey method takes the place of
+// the first method which offers keys
+func (s *sshAuth) addSigners(signers func() ([]ssh.Signer, error)) {
+	if len(s.signers) <= 0 {
+		s.methods = append(s.methods, ssh.PublicKeysCallback(s.allSigners))
+	}
+	s.signers = append(s.signers, signers)
+}
+
+func (s *sshAuth) allSigners() ([]ssh.Signer, error) {
+	all := make([]ssh.Signer, 0)
+	for _, signers := range s.signers {
+		found, err := signers()
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, found...)
+	}
+	return all, nil
+}
+
+func (s *sshAuth) close() {
+	if s.agent != nil {
+		s.agent.Close()
+	}
+}
+
+// hostAuth builds the chain of auth methods for a host. Methods which were
+// asked for explicitly with auth_methods must be usable, while the default
+// chain silently leaves out those which aren't configured, along with an
+// IdentityFile from the ssh config which is missing or encrypted
+func hostAuth(host *Host) (*sshAuth, error) {
+	names, explicit, err := authMethodNames(host.Vars)
+	if err != nil {
+		return nil, err
+	}
+	password, hasPassword := stringVar(host.Vars, "password")
+	keyFile, hasKeyFile := stringVar(host.Vars, "private_key_file")
+	auth := &sshAuth{methods: make([]ssh.AuthMethod, 0, len(names))}
+	for _, name := range names {
+		switch name {
+		case AgentAuth:
+			socket := os.Getenv("SSH_AUTH_SOCK")
+			if socket == "" {
+				if explicit {
+					auth.close()
+					return nil, errors.New("agent auth requested but SSH_AUTH_SOCK isn't set")
+				}
+				continue
+			}
+			conn, err := net.Dial("unix", socket)
+			if err != nil {
+				if explicit {
+					auth.close()
+					return nil, fmt.Errorf("Unable to connect to ssh-agent: %v", err)
+				}
+				continue
+			}
+			auth.agent = conn
+			auth.addSigners(agent.NewClient(conn).Signers)
+		case KeyAuth:
+			if !hasKeyFile {
+				if explicit {
+					auth.close()
+					return nil, errors.New("key auth requested but no private_key_file provided")
+				}
+				continue
+			}
+			passphrase, _ := stringVar(host.Vars, "private_key_passphrase")
+			signer, err := loadPrivateKey(keyFile, passphrase)
+			if err != nil {
+				if !explicit && host.configIdentityFile {
+					continue
+				}
+				auth.close()
+				return nil, err
+			}
+			auth.addSigners(func() ([]ssh.Signer, error) {
+				return []ssh.Signer{signer}, nil
+			})
+		case PasswordAuth:
+			if !hasPassword {
+				if explicit {
+					auth.close()
+					return nil, errors.New("password auth requested but no password provided")
+				}
+				continue
+			}
+			auth.methods = append(auth.methods, ssh.Password(password))
+		case KeyboardInteractiveAuth:
+			if !hasPassword {
+				if explicit {
+					auth.close()
+					return nil, errors.New("keyboard-interactive auth requested but no password provided")
+				}
+				continue
+			}
+			auth.methods = append(auth.methods, ssh.KeyboardInteractive(passwordChallenge(password)))
+		}
+	}
+	if len(auth.methods) <= 0 {
+		auth.close()
+		return nil, errors.New("no authentication methods available, provide a password, a private_key_file or run an ssh-agent")
+	}
+	return auth, nil
+}
+
+// authMethodNames returns the methods to try in order, and whether they were
+// chosen with auth_methods rather than being the default
+func authMethodNames(vars map[string]interface{}) ([]string, bool, error) {
+	value, exists := vars["auth_methods"]
+	if !exists || value == nil {
+		return defaultAuthMethods, false, nil
+	}
+	names := make([]string, 0)
+	switch v := value.(type) {
+	case []interface{}:
+		for _, element := range v {
+			names = append(names, strings.TrimSpace(toString(element)))
+		}
+	default:
+		for _, name := range strings.Split(toString(v), ",") {
+			names = append(names, strings.TrimSpace(name))
+		}
+	}
+	for _, name := range names {
+		switch name {
+		case AgentAuth, KeyAuth, PasswordAuth, KeyboardInteractiveAuth:
+		default:
+			return nil, false, fmt.Errorf("Unknown auth method: %v", name)
+		}
+	}
+	return names, true, nil
+}
+
+// loadPrivateKey reads a private key, decrypting it with passphrase when it's
+// encrypted
+func loadPrivateKey(keyFile, passphrase string) (ssh.Signer, error) {
+	keyFile, err := expandHome(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	contents, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read private_key_file: %v", err)
+	}
+	if passphrase != "" {
+		signer, err := ssh.ParsePrivateKeyWithPassphrase(contents, []byte(passphrase))
+		if err != nil {
+			return nil, fmt.Errorf("Unable to decrypt private key %v: %v", keyFile, err)
+		}
+		return signer, nil
+	}
+	signer, err := ssh.ParsePrivateKey(contents)
+	if err != nil {
+		var missing *ssh.PassphraseMissingError
+		if errors.As(err, &missing) {
+			return nil, fmt.Errorf("Private key %v is encrypted, provide private_key_passphrase", keyFile)
+		}
+		return nil, fmt.Errorf("Unable to parse private key %v: %v", keyFile, err)
+	}
+	return signer, nil
+}
+
+// passwordChallenge answers every keyboard-interactive question with the
+// password, which is all a password prompt asks
+func passwordChallenge(password string) ssh.KeyboardInteractiveChallenge {
+	return func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+		answers := make([]string, len(questions))
+		for index := range questions {
+			answers[index] = password
+		}
+		return answers, nil
+	}
+}
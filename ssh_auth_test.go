@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeTestKey(t *testing.T, passphrase string) (string, ssh.PublicKey) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Unable to generate key: %v\n", err)
+	}
+	block := &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}
+	if passphrase != "" {
+		block, err = x509.EncryptPEMBlock(rand.Reader, block.Type, block.Bytes, []byte(passphrase), x509.PEMCipherAES256)
+		if err != nil {
+			t.Fatalf("Unable to encrypt key: %v\n", err)
+		}
+	}
+	keyFile := filepath.Join(t.TempDir(), "id_rsa")
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatalf("Unable to write key: %v\n", err)
+	}
+	publicKey, err := ssh.NewPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("Unable to read public key: %v\n", err)
+	}
+	return keyFile, publicKey
+}
+
+func acceptKey(allowed ssh.PublicKey) func(ssh.ConnMetadata, ssh.PublicKey) (*ssh.Permissions, error) {
+	return func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+		if bytes.Equal(key.Marshal(), allowed.Marshal()) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("key rejected")
+	}
+}
+
+func TestSSHConnectPrivateKey(t *testing.T) {
+	t.Setenv("SSH_AUTH_SOCK", "")
+	keyFile, publicKey := writeTestKey(t, "hunter2")
+	port, _ := startTestSSHServer(t, &ssh.ServerConfig{PublicKeyCallback: acceptKey(publicKey)}, nil)
+
+	conn := &SSHConnection{}
+	err := conn.Connect(testHost(map[string]interface{}{
+		"username":               "deploy",
+		"port":                   port,
+		"host_key_checking":      "off",
+		"private_key_file":       keyFile,
+		"private_key_passphrase": "hunter2",
+	}))
+	if err != nil {
+		t.Fatalf("Expected to connect with an encrypted key: %v\n", err)
+	}
+	conn.Client.Close()
+
+	err = (&SSHConnection{}).Connect(testHost(map[string]interface{}{
+		"username":          "deploy",
+		"port":              port,
+		"host_key_checking": "off",
+		"private_key_file":  keyFile,
+	}))
+	connErr, ok := err.(*ConnectionError)
+	if !ok || connErr.Category() != AuthFailure {
+		t.Fatalf("A missing passphrase should be an auth failure, got %v\n", err)
+	}
+}
+
+func TestSSHConnectFallsBackThroughAuthMethods(t *testing.T) {
+	// The agent holds a key the server rejects, so the key file, then the
+	// password, then keyboard-interactive are tried in turn
+	_, agentKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Unable to generate agent key: %v\n", err)
+	}
+	keyring := agent.NewKeyring()
+	if err := keyring.Add(agent.AddedKey{PrivateKey: agentKey}); err != nil {
+		t.Fatalf("Unable to add key to agent: %v\n", err)
+	}
+	socket := filepath.Join(t.TempDir(), "agent.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("Unable to listen for test agent: %v\n", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go agent.ServeAgent(keyring, conn)
+		}
+	}()
+	t.Setenv("SSH_AUTH_SOCK", socket)
+
+	keyFile, _ := writeTestKey(t, "")
+	_, otherKey := writeTestKey(t, "")
+	attempts := make([]string, 0)
+	port, _ := startTestSSHServer(t, &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			attempts = append(attempts, key.Type())
+			return acceptKey(otherKey)(conn, key)
+		},
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			attempts = append(attempts, "password")
+			return nil, fmt.Errorf("password rejected")
+		},
+		KeyboardInteractiveCallback: func(conn ssh.ConnMetadata, challenge ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+			attempts = append(attempts, "keyboard-interactive")
+			answers, err := challenge("", "", []string{"Password: "}, []bool{false})
+			if err != nil || len(answers) != 1 || answers[0] != "secret" {
+				return nil, fmt.Errorf("wrong answer")
+			}
+			return nil, nil
+		},
+	}, nil)
+
+	conn := &SSHConnection{}
+	err = conn.Connect(testHost(map[string]interface{}{
+		"username":          "deploy",
+		"port":              port,
+		"host_key_checking": "off",
+		"private_key_file":  keyFile,
+		"password":          "secret",
+	}))
+	if err != nil {
+		t.Fatalf("Expected keyboard-interactive to succeed: %v\n", err)
+	}
+	conn.Client.Close()
+	expected := fmt.Sprint([]string{"ssh-ed25519", "ssh-rsa", "password", "keyboard-interactive"})
+	if fmt.Sprint(attempts) != expected {
+		t.Fatalf("Expected auth attempts %v, got %v\n", expected, attempts)
+	}
+}
+
+func TestHostAuthMethods(t *testing.T) {
+	t.Setenv("SSH_AUTH_SOCK", "")
+	_, err := hostAuth(testHost(map[string]interface{}{}))
+	if err == nil {
+		t.Fatalf("Expected an error without any auth configured\n")
+	}
+	_, err = hostAuth(testHost(map[string]interface{}{"password": "secret", "auth_methods": []interface{}{"agent"}}))
+	if err == nil {
+		t.Fatalf("Expected an error when agent auth is requested without an agent\n")
+	}
+	_, err = hostAuth(testHost(map[string]interface{}{"password": "secret", "auth_methods": "password,smoke-signals"}))
+	if err == nil {
+		t.Fatalf("Expected an error for an unknown auth method\n")
+	}
+	auth, err := hostAuth(testHost(map[string]interface{}{"password": "secret", "auth_methods": "keyboard-interactive"}))
+	if err != nil || len(auth.methods) != 1 {
+		t.Fatalf("Expected only keyboard-interactive auth, got %v %v\n", auth, err)
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Connection vars a host doesn't set are looked up in the OpenSSH client
+// config, ~/.ssh/config unless the ssh_config_file host var says otherwise.
+// The host is matched by its address var if it has one, otherwise its name.
+// As with ssh the first value found for an option is used, Host blocks may use
+// * and ? wildcards and ! to exclude, and Include reads more files. Match
+// blocks aren't supported and are skipped. The options used are
+//
+//	HostName              -> address
+//	User                  -> username
+//	Port                  -> port
+//	IdentityFile          -> private_key_file
+//	ProxyJump             -> proxy_jump
+//	StrictHostKeyChecking -> host_key_checking
+//	UserKnownHostsFile    -> known_hosts_file
+
+// Include can recurse, ssh gives up at the same depth
+const maxSSHConfigDepth = 16
+
+// sshConfigLookup collects the options which apply to a single host
+type sshConfigLookup struct {
+	hostname string
+	options  map[string]string
+}
+
+// withSSHConfig returns a copy of host whose vars are filled in from the ssh
+// config, the host's own vars take precedence. The exception is HostName,
+// which resolves the alias that was looked up so replaces its address
+func withSSHConfig(host *Host) (*Host, error) {
+	hostname := host.name
+	if address, exists := stringVar(host.Vars, "address"); exists {
+		hostname = address
+	}
+	configVars, err := sshConfigVars(host.Vars, hostname)
+	if err != nil {
+		return nil, err
+	}
+	address, resolved := configVars["address"]
+	_, configIdentityFile := configVars["private_key_file"]
+	if _, exists := host.Vars["private_key_file"]; exists {
+		configIdentityFile = false
+	}
+	for key, value := range host.Vars {
+		configVars[key] = value
+	}
+	if resolved {
+		configVars["address"] = address
+	}
+	return &Host{Vars: configVars, name: host.name, layers: host.layers, configIdentityFile: configIdentityFile}, nil
+}
+
+// sshConfigVars returns the connection vars the ssh config sets for hostname
+func sshConfigVars(vars map[string]interface{}, hostname string) (map[string]interface{}, error) {
+	configFile, exists := stringVar(vars, "ssh_config_file")
+	if !exists {
+		configFile = "~/.ssh/config"
+	}
+	configFile, err := expandHome(configFile)
+	if err != nil {
+		return nil, err
+	}
+	lookup := &sshConfigLookup{hostname: hostname, options: make(map[string]string, 0)}
+	if _, err := os.Stat(configFile); err == nil {
+		if err := lookup.readFile(configFile, 0); err != nil {
+			return nil, err
+		}
+	}
+
+	configVars := make(map[string]interface{}, 0)
+	if hostName, exists := lookup.options["hostname"]; exists {
+		configVars["address"] = strings.ReplaceAll(hostName, "%h", hostname)
+	}
+	if user, exists := lookup.options["user"]; exists {
+		configVars["username"] = user
+	}
+	if port, exists := lookup.options["port"]; exists {
+		configVars["port"] = port
+	}
+	if identityFile, exists := lookup.options["identityfile"]; exists {
+		configVars["private_key_file"] = identityFile
+	}
+	if proxyJump, exists := lookup.options["proxyjump"]; exists && strings.ToLower(proxyJump) != "none" {
+		configVars["proxy_jump"] = proxyJump
+	}
+	if knownHostsFile, exists := lookup.options["userknownhostsfile"]; exists {
+		configVars["known_hosts_file"] = strings.Fields(knownHostsFile)[0]
+	}
+	if checking, exists := lookup.options["stricthostkeychecking"]; exists {
+		switch strings.ToLower(checking) {
+		case "yes", "ask":
+			configVars["host_key_checking"] = StrictHostKeyChecking
+		case "accept-new":
+			configVars["host_key_checking"] = AcceptNewHostKeyChecking
+		case "no", "off":
+			configVars["host_key_checking"] = OffHostKeyChecking
+		}
+	}
+	return configVars, nil
+}
+
+func (s *sshConfigLookup) readFile(configFile string, depth int) error {
+	if depth > maxSSHConfigDepth {
+		return errors.New(fmt.Sprintf("ssh config includes nest too deeply at %v", configFile))
+	}
+	file, err := os.Open(configFile)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// Options before the first Host line apply to every host
+	active := true
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		keyword, args := parseSSHConfigLine(scanner.Text())
+		if keyword == "" {
+			continue
+		}
+		if len(args) <= 0 {
+			return errors.New(fmt.Sprintf("%v:%v: %v has no value", configFile, lineNumber, keyword))
+		}
+		switch keyword {
+		case "host":
+			active = matchSSHHostPatterns(args, s.hostname)
+		case "match":
+			active = false
+		case "include":
+			if !active {
+				continue
+			}
+			for _, pattern := range args {
+				if err := s.include(pattern, depth); err != nil {
+					return err
+				}
+			}
+		default:
+			if _, exists := s.options[keyword]; active && !exists {
+				s.options[keyword] = strings.Join(args, " ")
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+// include reads every file matching pattern, a relative pattern is relative
+// to ~/.ssh
+func (s *sshConfigLookup) include(pattern string, depth int) error {
+	pattern, err := expandHome(pattern)
+	if err != nil {
+		return err
+	}
+	if !filepath.IsAbs(pattern) {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return err
+		}
+		pattern = filepath.Join(home, ".ssh", pattern)
+	}
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return err
+	}
+	for _, match := range matches {
+		if err := s.readFile(match, depth+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseSSHConfigLine splits a line into its lowercased keyword and arguments.
+// The keyword may be separated from its arguments by whitespace or =, and
+// arguments may be double quoted
+func parseSSHConfigLine(line string) (string, []string) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", nil
+	}
+	end := strings.IndexAny(line, " \t=")
+	if end < 0 {
+		return strings.ToLower(line), nil
+	}
+	keyword := strings.ToLower(line[:end])
+	rest := strings.TrimLeft(line[end:], " \t")
+	rest = strings.TrimPrefix(rest, "=")
+
+	args := make([]string, 0)
+	var current strings.Builder
+	quoted, inArg := false, false
+	for _, char := range rest {
+		switch {
+		case char == '"':
+			quoted = !quoted
+			inArg = true
+		case (char == ' ' || char == '\t') && !quoted:
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteRune(char)
+			inArg = true
+		}
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+	return keyword, args
+}
+
+// matchSSHHostPatterns is whether a Host line applies to hostname, a negated
+// pattern which matches rules the host out whatever else matches
+func matchSSHHostPatterns(patterns []string, hostname string) bool {
+	matched := false
+	for _, pattern := range patterns {
+		negated := strings.HasPrefix(pattern, "!")
+		pattern = strings.TrimPrefix(pattern, "!")
+		if !matchSSHWildcard(pattern, hostname) {
+			continue
+		}
+		if negated {
+			return false
+		}
+		matched = true
+	}
+	return matched
+}
+
+func matchSSHWildcard(pattern, hostname string) bool {
+	expression := regexp.QuoteMeta(strings.ToLower(pattern))
+	expression = strings.ReplaceAll(expression, `\*`, ".*")
+	expression = strings.ReplaceAll(expression, `\?`, ".")
+	matched, _ := regexp.MatchString("^"+expression+"$", strings.ToLower(hostname))
+	return matched
+}
+
+func expandHome(file string) (string, error) {
+	if !strings.HasPrefix(file, "~/") {
+		return file, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, file[2:]), nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var testSSHConfig = `
+# Defaults before any Host apply everywhere
+IdentityFile ~/.ssh/default_key
+Include conf.d/*.conf
+
+Host web?? !web99
+    HostName %h.internal.example.com
+    User deploy
+    Port=2222
+
+Match host db*
+    User ignored
+
+Host db*
+    User "db admin"
+    ProxyJump bastion
+    StrictHostKeyChecking accept-new
+
+Host bastion
+    HostName 203.0.113.10
+    User jump
+
+Host *
+    User fallback
+    UserKnownHostsFile ~/.ssh/goat_known_hosts ~/.ssh/other
+`
+
+var testIncludedSSHConfig = `
+Host db*
+    Port 2200
+
+Host bastion
+    Include nested/*.conf
+`
+
+func writeTestSSHConfig(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	if err := os.MkdirAll(filepath.Join(home, ".ssh", "conf.d"), 0700); err != nil {
+		t.Fatalf("Unable to create ssh config directory: %v\n", err)
+	}
+	if err := os.WriteFile(filepath.Join(home, ".ssh", "config"), []byte(testSSHConfig), 0600); err != nil {
+		t.Fatalf("Unable to write ssh config: %v\n", err)
+	}
+	if err := os.WriteFile(filepath.Join(home, ".ssh", "conf.d", "db.conf"), []byte(testIncludedSSHConfig), 0600); err != nil {
+		t.Fatalf("Unable to write included ssh config: %v\n", err)
+	}
+}
+
+func TestSSHConfigVars(t *testing.T) {
+	writeTestSSHConfig(t)
+	cases := []struct {
+		hostname string
+		expected map[string]interface{}
+	}{
+		{"web01", map[string]interface{}{
+			"address":          "web01.internal.example.com",
+			"username":         "deploy",
+			"port":             "2222",
+			"private_key_file": "~/.ssh/default_key",
+			"known_hosts_file": "~/.ssh/goat_known_hosts",
+		}},
+		{"web99", map[string]interface{}{
+			"username":         "fallback",
+			"private_key_file": "~/.ssh/default_key",
+			"known_hosts_file": "~/.ssh/goat_known_hosts",
+		}},
+		{"db01", map[string]interface{}{
+			"username":          "db admin",
+			"port":              "2200",
+			"proxy_jump":        "bastion",
+			"host_key_checking": AcceptNewHostKeyChecking,
+			"private_key_file":  "~/.ssh/default_key",
+			"known_hosts_file":  "~/.ssh/goat_known_hosts",
+		}},
+	}
+	for _, c := range cases {
+		configVars, err := sshConfigVars(map[string]interface{}{}, c.hostname)
+		if err != nil {
+			t.Fatalf("Received error reading ssh config for %v: %v\n", c.hostname, err)
+		}
+		if len(configVars) != len(c.expected) {
+			t.Fatalf("Expected %v for %v, got %v\n", c.expected, c.hostname, configVars)
+		}
+		for key, value := range c.expected {
+			if configVars[key] != value {
+				t.Fatalf("Expected %v to be %v for %v, got %v\n", key, value, c.hostname, configVars)
+			}
+		}
+	}
+}
+
+func TestWithSSHConfigPrecedence(t *testing.T) {
+	writeTestSSHConfig(t)
+	host, err := withSSHConfig(&Host{
+		Vars: map[string]interface{}{"username": "root", "address": "web02"},
+		name: "frontend",
+	})
+	if err != nil {
+		t.Fatalf("Received error applying ssh config: %v\n", err)
+	}
+	if host.Vars["username"] != "root" || host.Vars["port"] != "2222" {
+		t.Fatalf("Host vars should take precedence over the ssh config: %v\n", host.Vars)
+	}
+	if host.Vars["address"] != "web02.internal.example.com" {
+		t.Fatalf("HostName should resolve the address: %v\n", host.Vars)
+	}
+
+	hops, err := jumpHops(&Host{
+		Vars: map[string]interface{}{"username": "root", "password": "secret", "proxy_jump": "bastion"},
+		name: "db01",
+	})
+	if err != nil || len(hops) != 1 {
+		t.Fatalf("Expected a single hop, got %v %v\n", hops, err)
+	}
+	if hops[0].Vars["address"] != "203.0.113.10" || hops[0].Vars["username"] != "jump" || hops[0].Vars["password"] != "secret" {
+		t.Fatalf("Expected the hop to be configured by the ssh config, got %v\n", hops[0].Vars)
+	}
+
+	// The IdentityFile everything gets doesn't exist, which only matters
+	// when key auth is asked for
+	t.Setenv("SSH_AUTH_SOCK", "")
+	host, err = withSSHConfig(&Host{Vars: map[string]interface{}{"password": "secret"}, name: "web01"})
+	if err != nil || host.Vars["private_key_file"] != "~/.ssh/default_key" {
+		t.Fatalf("Expected the IdentityFile to be used, got %v %v\n", host.Vars, err)
+	}
+	if auth, err := hostAuth(host); err != nil || len(auth.methods) != 2 {
+		t.Fatalf("A missing IdentityFile should be skipped, got %v %v\n", auth, err)
+	}
+	host.Vars["auth_methods"] = "key,password"
+	if _, err := hostAuth(host); err == nil {
+		t.Fatalf("Expected an error when key auth is requested with a missing IdentityFile\n")
+	}
+	host, _ = withSSHConfig(&Host{Vars: map[string]interface{}{"password": "secret", "private_key_file": "~/.ssh/default_key"}, name: "web01"})
+	if _, err := hostAuth(host); err == nil {
+		t.Fatalf("Expected an error for a missing private_key_file the host sets\n")
+	}
+
+	configVars, err := sshConfigVars(map[string]interface{}{"ssh_config_file": "/nonexistent/config"}, "web01")
+	if err != nil || len(configVars) != 0 {
+		t.Fatalf("A missing ssh config should set nothing, got %v %v\n", configVars, err)
+	}
+}
+
+func TestParseSSHConfigLine(t *testing.T) {
+	keyword, args := parseSSHConfigLine(`  IdentityFile = "~/My Keys/id_ed25519" extra`)
+	if keyword != "identityfile" || len(args) != 2 || args[0] != "~/My Keys/id_ed25519" || args[1] != "extra" {
+		t.Fatalf("Unexpected parse %v %v\n", keyword, args)
+	}
+	if keyword, _ := parseSSHConfigLine("# comment"); keyword != "" {
+		t.Fatalf("Comments should be ignored, got %v\n", keyword)
+	}
+}
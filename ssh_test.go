@@ -0,0 +1,241 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"net"
+	"os/exec"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// startTestSSHServer accepts connections on localhost until the test ends,
+// completing the handshake for any client config allows. A host key is
+// generated when hostKey is nil. It returns the port and the host key
+func startTestSSHServer(t *testing.T, config *ssh.ServerConfig, hostKey ssh.Signer) (string, ssh.Signer) {
+	if hostKey == nil {
+		hostKey = generateTestSigner(t)
+	}
+	config.AddHostKey(hostKey)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen for test ssh server: %v\n", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				serverConn, channels, requests, err := ssh.NewServerConn(conn, config)
+				if err != nil {
+					conn.Close()
+					return
+				}
+				go ssh.DiscardRequests(requests)
+				for channel := range channels {
+					switch channel.ChannelType() {
+					case "direct-tcpip":
+						go forwardTestChannel(channel)
+					case "session":
+						go serveTestSession(channel)
+					default:
+						channel.Reject(ssh.Prohibited, "test server")
+					}
+				}
+				serverConn.Close()
+			}()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	return port, hostKey
+}
+
+// forwardTestChannel connects a direct-tcpip channel to the address it asks
+// for, making the test server usable as a jump host
+func forwardTestChannel(newChannel ssh.NewChannel) {
+	var target struct {
+		Host       string
+		Port       uint32
+		OriginHost string
+		OriginPort uint32
+	}
+	if err := ssh.Unmarshal(newChannel.ExtraData(), &target); err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	conn, err := net.Dial("tcp", net.JoinHostPort(target.Host, fmt.Sprint(target.Port)))
+	if err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(requests)
+	go func() {
+		io.Copy(channel, conn)
+		channel.CloseWrite()
+	}()
+	io.Copy(conn, channel)
+	conn.Close()
+}
+
+// serveTestSession runs exec requests with the local shell, so commands can
+// be run against the test server. A signal request terminates the command.
+// The sftp subsystem serves the local filesystem
+func serveTestSession(newChannel ssh.NewChannel) {
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		return
+	}
+	var cmd *exec.Cmd
+	for request := range requests {
+		switch request.Type {
+		case "pty-req", "env":
+			request.Reply(true, nil)
+		case "signal":
+			if cmd != nil && cmd.Process != nil {
+				syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM)
+			}
+		case "subsystem":
+			var payload struct{ Name string }
+			if err := ssh.Unmarshal(request.Payload, &payload); err != nil || payload.Name != "sftp" || cmd != nil {
+				request.Reply(false, nil)
+				continue
+			}
+			server, err := sftp.NewServer(channel)
+			if err != nil {
+				request.Reply(false, nil)
+				continue
+			}
+			request.Reply(true, nil)
+			go func() {
+				server.Serve()
+				server.Close()
+				channel.Close()
+			}()
+		case "exec":
+			var payload struct{ Command string }
+			if err := ssh.Unmarshal(request.Payload, &payload); err != nil || cmd != nil {
+				request.Reply(false, nil)
+				continue
+			}
+			cmd = exec.Command("/bin/sh", "-c", payload.Command)
+			cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+			cmd.Stdout = channel
+			cmd.Stderr = channel.Stderr()
+			stdin, err := cmd.StdinPipe()
+			if err != nil || cmd.Start() != nil {
+				request.Reply(false, nil)
+				channel.Close()
+				return
+			}
+			request.Reply(true, nil)
+			go func() {
+				io.Copy(stdin, channel)
+				stdin.Close()
+			}()
+			go func(cmd *exec.Cmd) {
+				status := 0
+				if err := cmd.Wait(); err != nil {
+					status = 127
+					if exitErr, ok := err.(*exec.ExitError); ok {
+						status = exitErr.ExitCode()
+					}
+				}
+				channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{uint32(status)}))
+				channel.Close()
+			}(cmd)
+		default:
+			request.Reply(false, nil)
+		}
+	}
+}
+
+func generateTestSigner(t *testing.T) ssh.Signer {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Unable to generate key: %v\n", err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatalf("Unable to create key signer: %v\n", err)
+	}
+	return signer
+}
+
+func testHost(vars map[string]interface{}) *Host {
+	return &Host{Vars: vars, name: "127.0.0.1"}
+}
+
+func TestSSHRunTimeout(t *testing.T) {
+	conn := connectToTestServer(t)
+	started := time.Now()
+	result := conn.Run("echo started; sleep 10", RunOptions{Timeout: 200 * time.Millisecond})
+	if result.FailureCategory() != TimeoutFailure || !result.Failed() {
+		t.Fatalf("Expected a timeout failure, got %v %v\n", result.FailureCategory(), result.Error())
+	}
+	if elapsed := time.Since(started); elapsed > timeoutGrace {
+		t.Fatalf("Expected the command to be stopped by its signal, took %v\n", elapsed)
+	}
+	if result.Stdout() != "started\n" {
+		t.Fatalf("Expected the output from before the timeout, got %q\n", result.Stdout())
+	}
+
+	result = conn.Run("echo quick", RunOptions{Timeout: 5 * time.Second})
+	if result.Error() != nil || result.Stdout() != "quick\n" {
+		t.Fatalf("A command within its timeout should succeed, got %v %q\n", result.Error(), result.Stdout())
+	}
+}
+
+func TestSSHConnectTimeout(t *testing.T) {
+	// Accepts connections but never starts the SSH handshake
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %v\n", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+		}
+	}()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	for _, conn := range []*SSHConnection{{}, {ConnectTimeout: 200 * time.Millisecond}} {
+		vars := map[string]interface{}{
+			"username":          "deploy",
+			"password":          "secret",
+			"port":              port,
+			"host_key_checking": "off",
+		}
+		if conn.ConnectTimeout == 0 {
+			vars["connect_timeout"] = 0.2
+		}
+		started := time.Now()
+		err = conn.Connect(testHost(vars))
+		connErr, ok := err.(*ConnectionError)
+		if !ok || connErr.Category() != ConnectionFailure || !strings.Contains(err.Error(), "Timed out") {
+			t.Fatalf("Expected a timeout connecting, got %v\n", err)
+		}
+		if elapsed := time.Since(started); elapsed > time.Second {
+			t.Fatalf("Expected connecting to give up after the timeout, took %v\n", elapsed)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"sync"
+)
+
+// A strategy decides how a play's tasks are run across its hosts. Either way
+// at most forks hosts are running a task at once, a host which fails is
+// removed from the rest of the play and the play's failure thresholds are
+// respected.
+type strategy interface {
+	run(run *playRun)
+}
+
+const (
+	LinearStrategy = "linear"
+	FreeStrategy   = "free"
+)
+
+var strategies = map[string]strategy{
+	LinearStrategy: linearStrategy{},
+	FreeStrategy:   freeStrategy{},
+}
+
+// strategyByName returns the named strategy, linear when name is empty
+func strategyByName(name string) strategy {
+	if s, exists := strategies[name]; exists {
+		return s
+	}
+	return strategies[LinearStrategy]
+}
+
+// linearStrategy runs each task on every host before any host moves on to the
+// next task, so the slowest host holds back the rest
+type linearStrategy struct{}
+
+func (l linearStrategy) run(run *playRun) {
+	for _, task := range run.play.Tasks {
+		run.startTask(task)
+		activeHosts := run.activeHosts()
+		taskResults := run.runTaskOnHosts(task, activeHosts)
+		for index, host := range activeHosts {
+			run.record(task, host, taskResults[index])
+		}
+		if err := run.checkFailures(); err != nil {
+			run.abort(err)
+			return
+		}
+	}
+}
+
+// freeStrategy lets each host work through the task list as fast as it can,
+// without waiting for the other hosts. Output is printed as each host finishes
+// a task rather than in host order
+type freeStrategy struct{}
+
+func (f freeStrategy) run(run *playRun) {
+	for _, task := range run.play.Tasks {
+		run.startTask(task)
+	}
+
+	hosts := make(chan *Host)
+	var wg sync.WaitGroup
+	for worker := 0; worker < run.forks && worker < len(run.hosts); worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for host := range hosts {
+				f.runHost(run, host)
+			}
+		}()
+	}
+	for _, host := range run.hosts {
+		hosts <- host
+	}
+	close(hosts)
+	wg.Wait()
+}
+
+func (f freeStrategy) runHost(run *playRun, host *Host) {
+	for _, task := range run.play.Tasks {
+		if run.isAborted() || run.hasFailed(host) {
+			return
+		}
+		taskResult := run.play.runTask(task, run.executing[host.name], run.resolver)
+		run.record(task, host, taskResult)
+		if err := run.checkFailures(); err != nil {
+			run.abort(err)
+			return
+		}
+	}
+}
@@ -0,0 +1,459 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SynchronizeModule makes a remote directory match a local one. The remote
+// directory is listed once, and only files which are new or differ from
+// their local copy are transferred, so syncing an unchanged tree reports ok.
+// Files are compared by size and modification time, or by checksum. e.g.
+//
+//	tasks:
+//	  - name: release
+//	    synchronize:
+//	      src: build/
+//	      dest: /srv/app
+//	      delete: true
+//	      exclude: ["*.map", "tmp"]
+type SynchronizeModule struct {
+	// Local directory whose contents are synced, relative to the playbook's
+	// directory
+	Src string `yaml:"src"`
+	// Remote directory to sync into, created if it doesn't exist
+	Dest string `yaml:"dest"`
+	// Remove remote files and directories which aren't in src, and replace
+	// those which are a file in src but a directory on the host or the other
+	// way round. Without delete that's an error
+	Delete bool `yaml:"delete,omitempty"`
+	// Paths to leave alone, matched against each path relative to src and
+	// against its name, e.g. *.log or cache/tmp. Excluding a directory
+	// excludes everything in it. Excluded remote files are never deleted
+	Exclude []string `yaml:"exclude,omitempty"`
+	// Compare files by checksum rather than size and modification time
+	Checksum bool `yaml:"checksum,omitempty"`
+}
+
+// syncEntry is a file or directory in a synced tree, path is relative to
+// the tree's root and uses / separators
+type syncEntry struct {
+	path  string
+	isDir bool
+	size  int64
+	// Modification time in whole seconds
+	mtime    int64
+	mode     fs.FileMode
+	checksum string
+}
+
+// syncChange is a change made to the remote tree
+type syncChange struct {
+	path   string
+	action string
+}
+
+const (
+	syncCreated = "created"
+	syncUpdated = "updated"
+	syncDeleted = "deleted"
+)
+
+func (s SynchronizeModule) validate() error {
+	if s.Src == "" {
+		return errors.New("synchronize needs a src")
+	}
+	if s.Dest == "" {
+		return errors.New("synchronize needs a dest")
+	}
+	for _, pattern := range s.Exclude {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("Invalid exclude pattern %v", pattern)
+		}
+	}
+	return nil
+}
+
+// excluded is whether a relative path, or any directory it's in, matches
+// an exclude pattern
+func (s SynchronizeModule) excluded(relative string) bool {
+	for current := relative; current != "." && current != "/"; current = path.Dir(current) {
+		for _, pattern := range s.Exclude {
+			pattern = strings.TrimSuffix(pattern, "/")
+			if matched, _ := path.Match(pattern, current); matched {
+				return true
+			}
+			if matched, _ := path.Match(pattern, path.Base(current)); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// runSynchronize runs a synchronize task, baseDir is the directory a
+// relative src is in
+func runSynchronize(module SynchronizeModule, baseDir string, conn Connection, options RunOptions) TaskResult {
+	start := time.Now()
+	if err := module.validate(); err != nil {
+		return fileTaskError(err, start)
+	}
+	src, err := localPath(baseDir, module.Src)
+	if err != nil {
+		return fileTaskError(err, start)
+	}
+	local, err := module.localEntries(src)
+	if err != nil {
+		return fileTaskError(err, start)
+	}
+	remote, exists, err := module.remoteEntries(conn, options)
+	if err != nil {
+		return fileTaskError(err, start)
+	}
+
+	// Remote entries in the way of a local one of the other type are removed
+	// before anything is created, which only delete allows
+	removals := make([]string, 0)
+	directories := make([]string, 0)
+	transfers := make([]syncEntry, 0)
+	changes := make([]syncChange, 0)
+	for _, entry := range local {
+		existing, found := remote[entry.path]
+		if found && existing.isDir != entry.isDir {
+			if !module.Delete {
+				return fileTaskError(fmt.Errorf("%v is a %v on the host, set delete to replace it",
+					path.Join(module.Dest, entry.path), entryType(existing)), start)
+			}
+			removals = append(removals, entry.path)
+		}
+		action := syncUpdated
+		if !found {
+			action = syncCreated
+		}
+		if entry.isDir {
+			if !found || !existing.isDir {
+				directories = append(directories, entry.path)
+				changes = append(changes, syncChange{path: entry.path + "/", action: action})
+			}
+			continue
+		}
+		if found && !existing.isDir && !module.differs(entry, existing) {
+			continue
+		}
+		transfers = append(transfers, entry)
+		changes = append(changes, syncChange{path: entry.path, action: action})
+	}
+	deletions := make([]string, 0)
+	if module.Delete {
+		deletions = module.extraneous(local, remote)
+		for _, deleted := range deletions {
+			changes = append(changes, syncChange{path: deleted, action: syncDeleted})
+		}
+	}
+
+	result := fileResult{
+		details: map[string]interface{}{"dest": module.Dest},
+		start:   start,
+	}
+	if len(changes) > 0 {
+		err = module.apply(conn, src, exists, removals, directories, transfers, deletions, options)
+		if err != nil {
+			return fileTaskError(err, start)
+		}
+	}
+	registered := make([]interface{}, 0, len(changes))
+	messages := make([]string, 0, len(changes))
+	for _, change := range changes {
+		registered = append(registered, map[string]interface{}{"path": change.path, "action": change.action})
+		messages = append(messages, fmt.Sprintf("%v %v", change.action, change.path))
+	}
+	result.details["changes"] = registered
+	result.changed = len(changes) > 0
+	result.msg = strings.Join(messages, "\n")
+	if len(changes) <= 0 {
+		result.msg = fmt.Sprintf("%v is up to date", module.Dest)
+	}
+	result.end = time.Now()
+	return result
+}
+
+func entryType(entry syncEntry) string {
+	if entry.isDir {
+		return "directory"
+	}
+	return "file"
+}
+
+// differs is whether a local file needs to be transferred over a remote one
+func (s SynchronizeModule) differs(local, remote syncEntry) bool {
+	if s.Checksum {
+		return local.checksum != remote.checksum
+	}
+	return local.size != remote.size || local.mtime != remote.mtime
+}
+
+// localEntries walks src, returning everything which isn't excluded with
+// parent directories before their contents. Anything other than regular
+// files and directories, such as symlinks, is skipped
+func (s SynchronizeModule) localEntries(src string) ([]syncEntry, error) {
+	info, err := os.Stat(src)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("synchronize src %v isn't a directory", s.Src)
+	}
+	entries := make([]syncEntry, 0)
+	err = filepath.WalkDir(src, func(file string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if file == src {
+			return nil
+		}
+		relative, err := filepath.Rel(src, file)
+		if err != nil {
+			return err
+		}
+		relative = filepath.ToSlash(relative)
+		if s.excluded(relative) {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !entry.IsDir() && !entry.Type().IsRegular() {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		synced := syncEntry{
+			path:  relative,
+			isDir: entry.IsDir(),
+			size:  info.Size(),
+			mtime: info.ModTime().Unix(),
+			mode:  info.Mode().Perm(),
+		}
+		if s.Checksum && !synced.isDir {
+			content, err := os.ReadFile(file)
+			if err != nil {
+				return err
+			}
+			synced.checksum = checksum(content)
+		}
+		entries = append(entries, synced)
+		return nil
+	})
+	return entries, err
+}
+
+// remoteEntries lists dest with a single command, returning its entries by
+// path and whether it exists
+func (s SynchronizeModule) remoteEntries(conn Connection, options RunOptions) (map[string]syncEntry, bool, error) {
+	script := fmt.Sprintf("d=%v\n", quoteFilter(s.Dest)) +
+		`if [ ! -e "$d" ]; then echo missing; exit 0; fi` + "\n" +
+		`if [ ! -d "$d" ]; then echo file; exit 0; fi` + "\n" +
+		`cd -- "$d"` + "\n" +
+		`find . -mindepth 1 -printf '%y %s %T@ %P\0'` + "\n"
+	if s.Checksum {
+		script += `printf 'checksums\0'` + "\n" +
+			`find . -type f -exec sha256sum -z -- {} +` + "\n"
+	}
+	output, err := runRemote(conn, script, options)
+	if err != nil {
+		return nil, false, err
+	}
+	switch strings.TrimSpace(output) {
+	case "missing":
+		return map[string]syncEntry{}, false, nil
+	case "file":
+		return nil, false, fmt.Errorf("synchronize dest %v isn't a directory", s.Dest)
+	}
+
+	entries := make(map[string]syncEntry)
+	checksums := false
+	for _, record := range strings.Split(output, "\x00") {
+		if record == "" {
+			continue
+		}
+		if record == "checksums" {
+			checksums = true
+			continue
+		}
+		if checksums {
+			sum, file, found := strings.Cut(record, "  ")
+			entry, exists := entries[strings.TrimPrefix(file, "./")]
+			if !found || !exists {
+				return nil, false, fmt.Errorf("Unable to read checksum %q", record)
+			}
+			entry.checksum = sum
+			entries[entry.path] = entry
+			continue
+		}
+		fields := strings.SplitN(record, " ", 4)
+		if len(fields) != 4 {
+			return nil, false, fmt.Errorf("Unable to read listing of %v: %q", s.Dest, record)
+		}
+		size, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, false, fmt.Errorf("Unable to read listing of %v: %q", s.Dest, record)
+		}
+		seconds, _, _ := strings.Cut(fields[2], ".")
+		mtime, err := strconv.ParseInt(seconds, 10, 64)
+		if err != nil {
+			return nil, false, fmt.Errorf("Unable to read listing of %v: %q", s.Dest, record)
+		}
+		entries[fields[3]] = syncEntry{
+			path:  fields[3],
+			isDir: fields[0] == "d",
+			size:  size,
+			mtime: mtime,
+		}
+	}
+	return entries, true, nil
+}
+
+// extraneous returns the remote paths which aren't in local and aren't
+// excluded, leaving out those inside a directory which is itself extraneous.
+// A directory holding excluded entries is kept and only its other contents
+// are returned
+func (s SynchronizeModule) extraneous(local []syncEntry, remote map[string]syncEntry) []string {
+	wanted := make(map[string]bool, len(local))
+	for _, entry := range local {
+		wanted[entry.path] = true
+	}
+	paths := make([]string, 0, len(remote))
+	holding := make(map[string]bool)
+	for remotePath := range remote {
+		paths = append(paths, remotePath)
+		if s.excluded(remotePath) {
+			for dir := path.Dir(remotePath); dir != "."; dir = path.Dir(dir) {
+				holding[dir] = true
+			}
+		}
+	}
+	sort.Strings(paths)
+	extraneous := make([]string, 0)
+	deleted := make(map[string]bool)
+	for _, remotePath := range paths {
+		if wanted[remotePath] || holding[remotePath] || s.excluded(remotePath) {
+			continue
+		}
+		deleted[remotePath] = true
+		if !deleted[path.Dir(remotePath)] {
+			extraneous = append(extraneous, remotePath)
+		}
+	}
+	return extraneous
+}
+
+// maxSyncScriptSize is the most a single command applying changes may be,
+// well under the 128KB Linux allows for one argument since become wraps
+// the command again
+const maxSyncScriptSize = 64 * 1024
+
+// apply uploads the files to transfer and makes every change to dest, with
+// as few commands as fit under maxSyncScriptSize. Each file is staged before
+// being renamed into place, with its local permissions and modification time
+func (s SynchronizeModule) apply(conn Connection, src string, exists bool, removals, directories []string, transfers []syncEntry, deletions []string, options RunOptions) error {
+	if !exists && options.Become == nil && len(transfers) > 0 {
+		// Files are staged in dest, it has to exist first
+		if _, err := runRemote(conn, fmt.Sprintf("mkdir -p -- %v", quoteFilter(s.Dest)), options); err != nil {
+			return err
+		}
+	}
+	stage := newUploadStage(conn, options)
+	staged := make([]string, 0, len(transfers))
+	for _, entry := range transfers {
+		file, err := os.Open(filepath.Join(src, filepath.FromSlash(entry.path)))
+		if err != nil {
+			stage.remove()
+			return err
+		}
+		stagedPath, err := stage.upload(file, s.Dest, 0600)
+		file.Close()
+		if err != nil {
+			stage.remove()
+			return fmt.Errorf("Unable to upload %v: %v", entry.path, err)
+		}
+		staged = append(staged, stagedPath)
+	}
+	if err := stage.share(); err != nil {
+		stage.remove()
+		return err
+	}
+
+	commands := []string{fmt.Sprintf("mkdir -p -- %v\n", quoteFilter(s.Dest))}
+	for _, removal := range s.destPaths(removals) {
+		commands = append(commands, fmt.Sprintf("rm -rf -- %v\n", quoteFilter(removal)))
+	}
+	for _, directory := range s.destPaths(directories) {
+		commands = append(commands, fmt.Sprintf("mkdir -p -- %v\n", quoteFilter(directory)))
+	}
+	for index, entry := range transfers {
+		var command strings.Builder
+		stagedPath, target := quoteFilter(staged[index]), quoteFilter(path.Join(s.Dest, entry.path))
+		if options.Become != nil {
+			command.WriteString(fmt.Sprintf(`tmp=$(mktemp -- "$(dirname -- %v)/.goat-tmp-XXXXXX")`+"\n", target))
+			command.WriteString(fmt.Sprintf("cat -- %v > \"$tmp\"\n", stagedPath))
+		} else {
+			command.WriteString(fmt.Sprintf("tmp=%v\n", stagedPath))
+		}
+		command.WriteString(fmt.Sprintf("chmod %o \"$tmp\"\ntouch -m -d @%v \"$tmp\"\n", entry.mode, entry.mtime))
+		command.WriteString(fmt.Sprintf("mv -f -- \"$tmp\" %v\n", target))
+		commands = append(commands, command.String())
+	}
+	for _, deletion := range s.destPaths(deletions) {
+		commands = append(commands, fmt.Sprintf("rm -rf -- %v\n", quoteFilter(deletion)))
+	}
+
+	// Whatever is still staged when a command fails is removed afterwards
+	const header = "set -e\ntrap 'rm -f -- \"$tmp\"' EXIT\n"
+	var script strings.Builder
+	for index, command := range commands {
+		if script.Len() <= 0 {
+			script.WriteString(header)
+		}
+		script.WriteString(command)
+		last := index == len(commands)-1
+		if !last && script.Len()+len(commands[index+1]) <= maxSyncScriptSize {
+			continue
+		}
+		if _, err := runRemote(conn, script.String(), options); err != nil {
+			stage.remove()
+			return err
+		}
+		script.Reset()
+	}
+	if options.Become != nil {
+		stage.remove()
+	}
+	return nil
+}
+
+// destPaths turns paths relative to dest into remote paths
+func (s SynchronizeModule) destPaths(relative []string) []string {
+	paths := make([]string, 0, len(relative))
+	for _, relativePath := range relative {
+		paths = append(paths, path.Join(s.Dest, relativePath))
+	}
+	return paths
+}
+
+func quotePaths(paths []string) string {
+	quoted := make([]string, 0, len(paths))
+	for _, quotedPath := range paths {
+		quoted = append(quoted, quoteFilter(quotedPath))
+	}
+	return strings.Join(quoted, " ")
+}
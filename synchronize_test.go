@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestSynchronizeExcluded(t *testing.T) {
+	module := SynchronizeModule{Exclude: []string{"*.map", "cache/tmp", "logs/"}}
+	for relative, expected := range map[string]bool{
+		"app.js":          false,
+		"app.js.map":      true,
+		"js/app.js.map":   true,
+		"cache/tmp":       true,
+		"cache/tmp/a":     true,
+		"cache/other":     false,
+		"logs":            true,
+		"logs/access.log": true,
+		"web/logs/today":  true,
+	} {
+		if excluded := module.excluded(relative); excluded != expected {
+			t.Fatalf("Expected excluded(%v) to be %v\n", relative, expected)
+		}
+	}
+	if err := (SynchronizeModule{Src: "a", Dest: "b", Exclude: []string{"["}}).validate(); err == nil {
+		t.Fatalf("Expected an invalid exclude pattern to be an error\n")
+	}
+}
+
+func TestSSHSynchronize(t *testing.T) {
+	conn := connectToTestServer(t)
+	src := t.TempDir()
+	writeTree(t, src, map[string]string{
+		"index.html":    "<html></html>\n",
+		"js/app.js":     "console.log(1)\n",
+		"js/app.js.map": "{}\n",
+		"tmp/cache":     "cached\n",
+	})
+	dest := filepath.Join(t.TempDir(), "app")
+	module := SynchronizeModule{Src: src, Dest: dest, Exclude: []string{"*.map", "tmp"}}
+
+	result := runSynchronize(module, "", conn, RunOptions{})
+	assertSyncChanges(t, result, "created index.html", "created js/", "created js/app.js")
+	assertFile(t, filepath.Join(dest, "js", "app.js"), "console.log(1)\n", 0644)
+	for _, excluded := range []string{"js/app.js.map", "tmp"} {
+		if _, err := os.Stat(filepath.Join(dest, excluded)); err == nil {
+			t.Fatalf("Expected excluded %v not to be synced\n", excluded)
+		}
+	}
+
+	result = runSynchronize(module, "", conn, RunOptions{})
+	assertSyncChanges(t, result)
+
+	writeTree(t, src, map[string]string{"js/app.js": "console.log(22)\n"})
+	result = runSynchronize(module, "", conn, RunOptions{})
+	assertSyncChanges(t, result, "updated js/app.js")
+	assertFile(t, filepath.Join(dest, "js", "app.js"), "console.log(22)\n", 0644)
+
+	// The same size and modification time only differ by checksum
+	writeTree(t, src, map[string]string{"js/app.js": "console.log(33)\n"})
+	synced, _ := os.Stat(filepath.Join(dest, "js", "app.js"))
+	os.Chtimes(filepath.Join(src, "js", "app.js"), synced.ModTime(), synced.ModTime())
+	result = runSynchronize(module, "", conn, RunOptions{})
+	assertSyncChanges(t, result)
+	module.Checksum = true
+	result = runSynchronize(module, "", conn, RunOptions{})
+	assertSyncChanges(t, result, "updated js/app.js")
+	assertFile(t, filepath.Join(dest, "js", "app.js"), "console.log(33)\n", 0644)
+
+	// A directory in the way of a file is only replaced with delete
+	os.Remove(filepath.Join(dest, "index.html"))
+	writeTree(t, dest, map[string]string{"index.html/keep.map": "{}\n"})
+	result = runSynchronize(module, "", conn, RunOptions{})
+	if result.Error() == nil || !strings.Contains(result.Error().Error(), "delete") {
+		t.Fatalf("Expected an error replacing a directory without delete, got %v\n", result.Error())
+	}
+	assertFile(t, filepath.Join(dest, "index.html", "keep.map"), "{}\n", 0644)
+	os.RemoveAll(filepath.Join(dest, "index.html"))
+	result = runSynchronize(module, "", conn, RunOptions{})
+	assertSyncChanges(t, result, "created index.html")
+
+	writeTree(t, dest, map[string]string{
+		"old.txt":         "old\n",
+		"old/nested":      "old\n",
+		"keep.map":        "{}\n",
+		"logs/old.txt":    "old\n",
+		"logs/a/keep.map": "{}\n",
+	})
+	module.Delete = true
+	result = runSynchronize(module, "", conn, RunOptions{})
+	assertSyncChanges(t, result, "deleted logs/old.txt", "deleted old", "deleted old.txt")
+	for _, kept := range []string{"keep.map", "logs/a/keep.map"} {
+		if _, err := os.Stat(filepath.Join(dest, kept)); err != nil {
+			t.Fatalf("Expected excluded %v not to be deleted\n", kept)
+		}
+	}
+	assertNothingStaged(t, dest)
+}
+
+// failingConnection fails any command containing fail
+type failingConnection struct {
+	*SSHConnection
+	fail string
+}
+
+func (f failingConnection) Run(command string, options RunOptions) TaskResult {
+	if strings.Contains(command, f.fail) {
+		return f.SSHConnection.Run("exit 1", options)
+	}
+	return f.SSHConnection.Run(command, options)
+}
+
+func TestSSHSynchronizeManyFiles(t *testing.T) {
+	conn := connectToTestServer(t)
+	src := t.TempDir()
+	files := make(map[string]string)
+	for index := 0; index < 1500; index++ {
+		files[fmt.Sprintf("assets/a-rather-long-file-name-to-fill-the-script-%04d.txt", index)] = strconv.Itoa(index)
+	}
+	writeTree(t, src, files)
+	dest := filepath.Join(t.TempDir(), "app")
+
+	// Nothing is left staged when applying the changes fails
+	result := runSynchronize(SynchronizeModule{Src: src, Dest: dest}, "", failingConnection{conn, "mv -f"}, RunOptions{})
+	if result.Error() == nil {
+		t.Fatalf("Expected a failing command to be an error\n")
+	}
+	assertNothingStaged(t, dest)
+
+	result = runSynchronize(SynchronizeModule{Src: src, Dest: dest}, "", conn, RunOptions{})
+	if result.Error() != nil || !result.Changed() {
+		t.Fatalf("Expected 1500 files to be synced, got %v %v\n", result.Changed(), result.Error())
+	}
+	for name, content := range files {
+		assertFile(t, filepath.Join(dest, name), content, 0644)
+	}
+	assertNothingStaged(t, dest)
+}
+
+func TestSSHSynchronizeBecome(t *testing.T) {
+	installFakeBecome(t)
+	conn := connectToTestServer(t)
+	src := t.TempDir()
+	writeTree(t, src, map[string]string{"bin/run": "#!/bin/sh\n"})
+	os.Chmod(filepath.Join(src, "bin", "run"), 0755)
+	dest := filepath.Join(t.TempDir(), "app")
+	options := RunOptions{Become: &Become{User: "root", Method: SudoBecome, Password: "correct"}}
+
+	result := runSynchronize(SynchronizeModule{Src: src, Dest: dest, Checksum: true}, "", conn, options)
+	assertSyncChanges(t, result, "created bin/", "created bin/run")
+	assertFile(t, filepath.Join(dest, "bin", "run"), "#!/bin/sh\n", 0755)
+	result = runSynchronize(SynchronizeModule{Src: src, Dest: dest, Checksum: true}, "", conn, options)
+	assertSyncChanges(t, result)
+}
+
+func assertNothingStaged(t *testing.T, dest string) {
+	t.Helper()
+	entries, _ := os.ReadDir(dest)
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".goat-tmp-") {
+			t.Fatalf("Temporary file %v was left behind\n", entry.Name())
+		}
+	}
+}
+
+func writeTree(t *testing.T, root string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		file := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatalf("Unable to create directory for %v: %v\n", name, err)
+		}
+		if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatalf("Unable to write %v: %v\n", name, err)
+		}
+	}
+}
+
+func assertSyncChanges(t *testing.T, result TaskResult, expected ...string) {
+	t.Helper()
+	if result.Error() != nil {
+		t.Fatalf("Unexpected error synchronizing: %v\n", result.Error())
+	}
+	changes := make([]string, 0)
+	for _, change := range registeredResult(result)["changes"].([]interface{}) {
+		details := change.(map[string]interface{})
+		changes = append(changes, details["action"].(string)+" "+details["path"].(string))
+	}
+	sort.Strings(changes)
+	if strings.Join(changes, ",") != strings.Join(expected, ",") || result.Changed() != (len(expected) > 0) {
+		t.Fatalf("Expected changes %v, got %v changed %v\n", expected, changes, result.Changed())
+	}
+}
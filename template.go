@@ -0,0 +1,257 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"text/template"
+	"text/template/parse"
+)
+
+// Task strings are go templates rendered against the variables resolved for
+// the host the task is running on, e.g.
+//
+//	cmd: systemctl restart {{ .service_name }}
+//
+// Rendering is strict, referencing a variable which isn't defined is an error
+// rather than silently rendering "<no value>". A variable may be left
+// undefined when it's given a fallback with default, {{ default "nginx" .service_name }}
+// or {{ .service_name | default "nginx" }}, or when it's only tested by an if.
+// Variables used inside with and range, or through a $variable, can't be
+// checked before rendering, so rendering "<no value>" anywhere is an error too.
+
+// TemplateError is returned when a task string can't be parsed or rendered
+type TemplateError struct {
+	Field string
+	Err   error
+}
+
+func (t *TemplateError) Error() string {
+	if t.Field == "" {
+		return t.Err.Error()
+	}
+	return fmt.Sprintf("Error rendering %v: %v", t.Field, t.Err)
+}
+
+// noValue is what text/template renders for a missing map key
+const noValue = "<no value>"
+
+// renderTemplate renders a single template string against vars
+func renderTemplate(name, text string, vars map[string]interface{}) (string, error) {
+	if !strings.Contains(text, "{{") {
+		return text, nil
+	}
+	tmpl, err := template.New(name).Funcs(templateFuncs()).Parse(text)
+	if err != nil {
+		return "", &TemplateError{Field: name, Err: err}
+	}
+
+	if err := checkDefined(tmpl.Tree.Root, vars); err != nil {
+		return "", &TemplateError{Field: name, Err: err}
+	}
+
+	var sb strings.Builder
+	if err := tmpl.Execute(&sb, vars); err != nil {
+		return "", &TemplateError{Field: name, Err: err}
+	}
+	if strings.Contains(sb.String(), noValue) && !strings.Contains(text, noValue) {
+		return "", &TemplateError{Field: name, Err: fmt.Errorf("undefined variable rendered as %q", noValue)}
+	}
+	return sb.String(), nil
+}
+
+// renderTask returns a copy of the task with every string field rendered,
+// including those in nested structs, slices and maps. Fields tagged with
+// `template:"-"` are left as they are, such as the task's name which is
+// what its results are recorded under.
+func renderTask(task CommandTask, vars map[string]interface{}) (CommandTask, error) {
+	rendered := reflect.New(reflect.TypeOf(task)).Elem()
+	rendered.Set(reflect.ValueOf(task))
+	if err := renderValue(rendered, "", vars); err != nil {
+		return CommandTask{}, err
+	}
+	return rendered.Interface().(CommandTask), nil
+}
+
+func renderValue(value reflect.Value, field string, vars map[string]interface{}) error {
+	switch value.Kind() {
+	case reflect.String:
+		text, err := renderTemplate(field, value.String(), vars)
+		if err != nil {
+			return err
+		}
+		value.SetString(text)
+	case reflect.Struct:
+		for index := 0; index < value.NumField(); index++ {
+			structField := value.Type().Field(index)
+			if !structField.IsExported() || structField.Tag.Get("template") == "-" {
+				continue
+			}
+			if err := renderValue(value.Field(index), joinField(field, yamlName(structField)), vars); err != nil {
+				return err
+			}
+		}
+	case reflect.Pointer:
+		if value.IsNil() {
+			return nil
+		}
+		copied := reflect.New(value.Elem().Type())
+		copied.Elem().Set(value.Elem())
+		if err := renderValue(copied.Elem(), field, vars); err != nil {
+			return err
+		}
+		value.Set(copied)
+	case reflect.Slice:
+		if value.IsNil() {
+			return nil
+		}
+		copied := reflect.MakeSlice(value.Type(), value.Len(), value.Len())
+		reflect.Copy(copied, value)
+		for index := 0; index < copied.Len(); index++ {
+			if err := renderValue(copied.Index(index), fmt.Sprintf("%v[%v]", field, index), vars); err != nil {
+				return err
+			}
+		}
+		value.Set(copied)
+	case reflect.Map:
+		if value.IsNil() {
+			return nil
+		}
+		copied := reflect.MakeMapWithSize(value.Type(), value.Len())
+		iter := value.MapRange()
+		for iter.Next() {
+			element := reflect.New(iter.Value().Type()).Elem()
+			element.Set(iter.Value())
+			if err := renderValue(element, joinField(field, fmt.Sprintf("%v", iter.Key())), vars); err != nil {
+				return err
+			}
+			copied.SetMapIndex(iter.Key(), element)
+		}
+		value.Set(copied)
+	case reflect.Interface:
+		if value.IsNil() {
+			return nil
+		}
+		element := reflect.New(value.Elem().Type()).Elem()
+		element.Set(value.Elem())
+		if err := renderValue(element, field, vars); err != nil {
+			return err
+		}
+		value.Set(element)
+	}
+	return nil
+}
+
+func yamlName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+	if name == "" {
+		return strings.ToLower(field.Name)
+	}
+	return name
+}
+
+func joinField(parent, child string) string {
+	if parent == "" {
+		return child
+	}
+	return parent + "." + child
+}
+
+// checkDefined walks a parsed template returning an error for the first
+// variable it references which isn't defined in vars. Variables passed to
+// default, or tested by an if or with, are allowed to be undefined. The dot
+// changes inside of with and range blocks so they aren't checked.
+func checkDefined(node parse.Node, vars map[string]interface{}) error {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return nil
+		}
+		for _, child := range n.Nodes {
+			if err := checkDefined(child, vars); err != nil {
+				return err
+			}
+		}
+	case *parse.ActionNode:
+		return checkPipeDefined(n.Pipe, vars, false)
+	case *parse.IfNode:
+		if err := checkPipeDefined(n.Pipe, vars, true); err != nil {
+			return err
+		}
+		if err := checkDefined(n.List, vars); err != nil {
+			return err
+		}
+		return checkDefined(n.ElseList, vars)
+	case *parse.WithNode:
+		if err := checkPipeDefined(n.Pipe, vars, true); err != nil {
+			return err
+		}
+		return checkDefined(n.ElseList, vars)
+	case *parse.RangeNode:
+		if err := checkPipeDefined(n.Pipe, vars, false); err != nil {
+			return err
+		}
+		return checkDefined(n.ElseList, vars)
+	}
+	return nil
+}
+
+func checkPipeDefined(pipe *parse.PipeNode, vars map[string]interface{}, guarded bool) error {
+	if pipe == nil {
+		return nil
+	}
+	for index, cmd := range pipe.Cmds {
+		// The result of a command is passed on to the next, so a later
+		// default guards everything before it
+		cmdGuarded := guarded
+		for _, later := range pipe.Cmds[index+1:] {
+			if isDefaultCall(later) {
+				cmdGuarded = true
+			}
+		}
+		if isDefaultCall(cmd) {
+			cmdGuarded = true
+		}
+		for _, arg := range cmd.Args {
+			switch a := arg.(type) {
+			case *parse.FieldNode:
+				if cmdGuarded {
+					continue
+				}
+				if _, defined := lookupVar(vars, a.Ident); !defined {
+					return fmt.Errorf("undefined variable %q", strings.Join(a.Ident, "."))
+				}
+			case *parse.PipeNode:
+				if err := checkPipeDefined(a, vars, cmdGuarded); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func isDefaultCall(cmd *parse.CommandNode) bool {
+	if len(cmd.Args) <= 0 {
+		return false
+	}
+	identifier, ok := cmd.Args[0].(*parse.IdentifierNode)
+	return ok && identifier.Ident == "default"
+}
+
+// lookupVar follows a dotted path of keys through nested maps
+func lookupVar(vars map[string]interface{}, path []string) (interface{}, bool) {
+	var current interface{} = vars
+	for _, key := range path {
+		value := reflect.ValueOf(current)
+		if value.Kind() != reflect.Map || value.Type().Key().Kind() != reflect.String {
+			return nil, false
+		}
+		element := value.MapIndex(reflect.ValueOf(key).Convert(value.Type().Key()))
+		if !element.IsValid() {
+			return nil, false
+		}
+		current = element.Interface()
+	}
+	return current, true
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// TemplateModule renders a local template file against the host's variables
+// and uploads the result the way copy does, so it's only changed when the
+// rendered content differs. Templates are go templates, see template.go. e.g.
+//
+//	tasks:
+//	  - name: nginx config
+//	    template:
+//	      src: templates/nginx.conf.tmpl
+//	      dest: /etc/nginx/nginx.conf
+//	      mode: "0644"
+//	      validate: nginx -t -c %s
+type TemplateModule struct {
+	// Local template file, relative to the playbook's directory
+	Src  string `yaml:"src"`
+	Dest string `yaml:"dest"`
+	// Permissions for dest, as in CopyModule
+	Mode  string `yaml:"mode,omitempty"`
+	Owner string `yaml:"owner,omitempty"`
+	Group string `yaml:"group,omitempty"`
+	// Keep the previous version of dest next to it
+	Backup bool `yaml:"backup,omitempty"`
+	// Command run against the rendered file before it replaces dest, %s is
+	// replaced with its path. dest is left alone if the command fails
+	Validate string `yaml:"validate,omitempty"`
+}
+
+func (t TemplateModule) validate() error {
+	if t.Src == "" {
+		return errors.New("template needs a src")
+	}
+	if t.Dest == "" {
+		return errors.New("template needs a dest")
+	}
+	if t.Validate != "" && !strings.Contains(t.Validate, "%s") {
+		return errors.New("template validate needs a %s for the file's path")
+	}
+	return nil
+}
+
+func (t TemplateModule) install() fileInstall {
+	return fileInstall{
+		attrs:    fileAttributes{Mode: t.Mode, Owner: t.Owner, Group: t.Group},
+		backup:   t.Backup,
+		validate: t.Validate,
+	}
+}
+
+// runTemplate runs a template task, baseDir is the directory relative srcs
+// are in
+func runTemplate(module TemplateModule, baseDir string, vars map[string]interface{}, conn Connection, options RunOptions) TaskResult {
+	start := time.Now()
+	if err := module.validate(); err != nil {
+		return fileTaskError(err, start)
+	}
+	src, err := localPath(baseDir, module.Src)
+	if err != nil {
+		return fileTaskError(err, start)
+	}
+	text, err := os.ReadFile(src)
+	if err != nil {
+		return fileTaskError(err, start)
+	}
+	rendered, err := renderTemplate(module.Src, string(text), vars)
+	if err != nil {
+		return fileTaskError(fmt.Errorf("Error rendering template: %v", err), start)
+	}
+	return installFile([]byte(rendered), module.Src, module.Dest, module.install(), conn, options, start)
+}
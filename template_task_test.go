@@ -0,0 +1,71 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTemplateModuleValidate(t *testing.T) {
+	for _, task := range []string{
+		"template: {dest: /etc/app.conf}",
+		"template: {src: app.conf.tmpl}",
+		"template: {src: app.conf.tmpl, dest: /etc/app.conf, validate: app --check}",
+		"{copy: {content: hello, dest: /tmp/hello}, template: {src: app.conf.tmpl, dest: /etc/app.conf}}",
+	} {
+		_, err := playbookFromContents([]byte("hosts: [all]\ntasks:\n  - " + task + "\n"))
+		if err == nil {
+			t.Fatalf("Expected an error for task %v\n", task)
+		}
+	}
+}
+
+func TestSSHTemplate(t *testing.T) {
+	conn := connectToTestServer(t)
+	local := t.TempDir()
+	if err := os.WriteFile(filepath.Join(local, "app.conf.tmpl"), []byte("listen {{ .app_port }}\n"), 0644); err != nil {
+		t.Fatalf("Unable to write template: %v\n", err)
+	}
+	dir := t.TempDir()
+	dest := filepath.Join(dir, "app.conf")
+	module := TemplateModule{Src: "app.conf.tmpl", Dest: dest, Mode: "0644", Validate: "grep -q listen %s"}
+	vars := map[string]interface{}{"app_port": 80}
+
+	result := runTemplate(module, local, vars, conn, RunOptions{})
+	if result.Error() != nil || !result.Changed() {
+		t.Fatalf("Expected the template to be rendered, got %v %v\n", result.Changed(), result.Error())
+	}
+	assertFile(t, dest, "listen 80\n", 0644)
+
+	result = runTemplate(module, local, vars, conn, RunOptions{})
+	if result.Error() != nil || result.Changed() {
+		t.Fatalf("Expected the same rendered content to be ok, got %v %v\n", result.Changed(), result.Error())
+	}
+
+	vars["app_port"] = 8080
+	result = runTemplate(module, local, vars, conn, RunOptions{})
+	if result.Error() != nil || !result.Changed() {
+		t.Fatalf("Expected new variables to change the file, got %v %v\n", result.Changed(), result.Error())
+	}
+	assertFile(t, dest, "listen 8080\n", 0644)
+
+	// A file which fails validation never replaces dest
+	vars["app_port"] = 443
+	module.Validate = "grep -q 'listen 80$' %s"
+	module.Backup = true
+	result = runTemplate(module, local, vars, conn, RunOptions{})
+	if result.Error() == nil || !strings.Contains(result.Error().Error(), "Validation failed") {
+		t.Fatalf("Expected validation to fail, got %v\n", result.Error())
+	}
+	assertFile(t, dest, "listen 8080\n", 0644)
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Fatalf("Expected only dest to be left after failed validation, found %v\n", entries)
+	}
+
+	result = runTemplate(module, local, map[string]interface{}{}, conn, RunOptions{})
+	if result.Error() == nil || result.FailureCategory() != CommandFailure {
+		t.Fatalf("Expected an undefined variable to fail, got %v\n", result.Error())
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRenderTaskWithVars(t *testing.T) {
+	task := CommandTask{
+		Name: "restart {{ .service_name }}",
+		Cmd:  "systemctl restart {{ .service_name }}",
+	}
+	rendered, err := renderTask(task, map[string]interface{}{"service_name": "nginx"})
+	if err != nil {
+		t.Fatalf("Received error when rendering task: %v\n", err)
+	}
+	if rendered.Cmd != "systemctl restart nginx" {
+		t.Fatalf("Task cmd wasn't rendered: %v\n", rendered.Cmd)
+	}
+	if rendered.Name != task.Name {
+		t.Fatalf("Task name shouldn't be rendered: %v\n", rendered.Name)
+	}
+	if task.Cmd != "systemctl restart {{ .service_name }}" {
+		t.Fatalf("Rendering modified the original task: %v\n", task.Cmd)
+	}
+}
+
+func TestRenderTemplateUndefinedVariable(t *testing.T) {
+	_, err := renderTemplate("cmd", "systemctl restart {{ .service_name }}", map[string]interface{}{})
+	if err == nil {
+		t.Fatalf("Expected an error for an undefined variable\n")
+	}
+	if _, ok := err.(*TemplateError); !ok || !strings.Contains(err.Error(), "service_name") {
+		t.Fatalf("Error should've been a TemplateError naming the variable: %v\n", err)
+	}
+
+	vars := map[string]interface{}{
+		"m": map[string]interface{}{"name": "web"},
+		"l": []interface{}{map[string]interface{}{"name": "web"}},
+	}
+	for _, text := range []string{
+		"{{ with .m }}{{ .nope }}{{ end }}",
+		"{{ range .l }}{{ .nope }}{{ end }}",
+		"{{ $x := .m }}{{ $x.nope }}",
+	} {
+		if rendered, err := renderTemplate("cmd", text, vars); err == nil {
+			t.Fatalf("Expected an error for an undefined variable in %v, got %q\n", text, rendered)
+		}
+	}
+	rendered, err := renderTemplate("cmd", "{{ with .m }}{{ .name }}{{ end }} {{ range .l }}{{ .name }}{{ end }}", vars)
+	if err != nil || rendered != "web web" {
+		t.Fatalf("Expected defined variables in with and range to render, got %q %v\n", rendered, err)
+	}
+}
+
+func TestRenderTemplateDefault(t *testing.T) {
+	cases := map[string]interface{}{
+		`{{ default "nginx" .service_name }}`:               "nginx",
+		`{{ .service_name | default "nginx" }}`:             "nginx",
+		`{{ .port | default "80" }}`:                        "8080",
+		`{{ if .service_name }}set{{ else }}unset{{ end }}`: "unset",
+	}
+	for text, expected := range cases {
+		rendered, err := renderTemplate("cmd", text, map[string]interface{}{"port": "8080"})
+		if err != nil {
+			t.Fatalf("Received error when rendering %v: %v\n", text, err)
+		}
+		if rendered != expected {
+			t.Fatalf("Rendering %v gave %v, expected %v\n", text, rendered, expected)
+		}
+	}
+}
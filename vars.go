@@ -0,0 +1,251 @@
+package main
+
+import (
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Variables are resolved for a host by layering every source of variables on
+// top of each other. From lowest to highest precedence:
+//
+//  1. inventory vars, the top level vars of the inventory file
+//  2. ancestor group vars, starting with all
+//  3. nearer group vars, deeper groups override their ancestors
+//  4. host vars
+//  5. playbook vars
+//  6. task vars
+//  7. registered vars, the results of earlier tasks on the host
+//  8. extra vars, passed on the command line with --extra-vars
+//
+// Layers 1 through 4 are collected onto each host when the inventory is
+// resolved (see Inventory.collectHosts), ResolveVars merges them with the rest.
+//
+// Each step either replaces a variable defined by a lower step, the default,
+// or deep merges into it. When merging, maps are merged key by key all the
+// way down while any other value, lists included, is replaced. The behaviour
+// is chosen per step with a playbook's var_merge, e.g.
+//
+//	var_merge:
+//	  group: merge
+//	  play: merge
+type VarResolver struct {
+	ExtraVars  map[string]interface{}
+	registered map[string]map[string]interface{}
+	// Tasks run on many hosts at once, registering and resolving at the same
+	// time
+	mutex sync.RWMutex
+}
+
+const (
+	InventoryVarsStep  = "inventory"
+	GroupVarsStep      = "group"
+	HostVarsStep       = "host"
+	PlayVarsStep       = "play"
+	TaskVarsStep       = "task"
+	RegisteredVarsStep = "registered"
+	ExtraVarsStep      = "extra"
+)
+
+const (
+	ReplaceVarMerge = "replace"
+	DeepVarMerge    = "merge"
+)
+
+// varLayer is the variables a single step contributes
+type varLayer struct {
+	step string
+	vars map[string]interface{}
+}
+
+func NewVarResolver(extraVars map[string]interface{}) *VarResolver {
+	if extraVars == nil {
+		extraVars = make(map[string]interface{}, 0)
+	}
+	return &VarResolver{
+		ExtraVars:  extraVars,
+		registered: make(map[string]map[string]interface{}, 0),
+	}
+}
+
+// ResolveVars returns the variables visible to a task running on host. The
+// returned map is a copy and can be modified freely
+func (r *VarResolver) ResolveVars(host *Host, play Playbook, task CommandTask) map[string]interface{} {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	layers := host.varLayers()
+	layers = append(layers,
+		varLayer{step: PlayVarsStep, vars: play.Vars},
+		varLayer{step: TaskVarsStep, vars: task.Vars},
+		varLayer{step: RegisteredVarsStep, vars: r.registered[host.name]},
+		varLayer{step: ExtraVarsStep, vars: r.ExtraVars},
+	)
+	return mergeVarLayers(layers, play.VarMerge)
+}
+
+// Register stores a variable on a host for the tasks which run after it
+func (r *VarResolver) Register(host *Host, name string, value interface{}) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if _, exists := r.registered[host.name]; !exists {
+		r.registered[host.name] = make(map[string]interface{}, 0)
+	}
+	r.registered[host.name][name] = value
+}
+
+// varLayers returns the inventory layers the host's vars were merged from. A
+// host which didn't come from an inventory only has its own vars
+func (h *Host) varLayers() []varLayer {
+	if len(h.layers) > 0 {
+		layers := make([]varLayer, len(h.layers))
+		copy(layers, h.layers)
+		return layers
+	}
+	return []varLayer{{step: HostVarsStep, vars: h.Vars}}
+}
+
+// mergeVarLayers merges layers, lowest precedence first, into a new map. policy
+// maps a step to its merge behaviour, steps which aren't in it are replaced
+func mergeVarLayers(layers []varLayer, policy map[string]string) map[string]interface{} {
+	merged := make(map[string]interface{}, 0)
+	for _, layer := range layers {
+		deep := policy[layer.step] == DeepVarMerge
+		for varKey, varValue := range layer.vars {
+			existing, exists := merged[varKey]
+			if deep && exists {
+				merged[varKey] = deepMergeValue(existing, varValue)
+				continue
+			}
+			merged[varKey] = copyValue(varValue)
+		}
+	}
+	return merged
+}
+
+func deepMergeValue(existing, value interface{}) interface{} {
+	existingMap, existingIsMap := existing.(map[string]interface{})
+	valueMap, valueIsMap := value.(map[string]interface{})
+	if !existingIsMap || !valueIsMap {
+		return copyValue(value)
+	}
+	merged := copyValue(existingMap).(map[string]interface{})
+	for key, element := range valueMap {
+		if current, exists := merged[key]; exists {
+			merged[key] = deepMergeValue(current, element)
+			continue
+		}
+		merged[key] = copyValue(element)
+	}
+	return merged
+}
+
+// copyValue deep copies the maps and lists of a variable so merged variables
+// never share them with the inventory or playbook
+func copyValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		copied := make(map[string]interface{}, len(v))
+		for key, element := range v {
+			copied[key] = copyValue(element)
+		}
+		return copied
+	case []interface{}:
+		copied := make([]interface{}, len(v))
+		for index, element := range v {
+			copied[index] = copyValue(element)
+		}
+		return copied
+	}
+	return value
+}
+
+func validateVarMerge(policy map[string]string) error {
+	for step, behaviour := range policy {
+		switch step {
+		case InventoryVarsStep, GroupVarsStep, HostVarsStep, PlayVarsStep,
+			TaskVarsStep, RegisteredVarsStep, ExtraVarsStep:
+		default:
+			return fmt.Errorf("Unknown var_merge step: %v", step)
+		}
+		if behaviour != ReplaceVarMerge && behaviour != DeepVarMerge {
+			return fmt.Errorf("var_merge for %v should be %v or %v, got: %v",
+				step, ReplaceVarMerge, DeepVarMerge, behaviour)
+		}
+	}
+	return nil
+}
+
+// stringVar returns a variable formatted as a string, for settings such as a
+// port which may have been written as a number
+func stringVar(vars map[string]interface{}, key string) (string, bool) {
+	value, exists := vars[key]
+	if !exists || value == nil {
+		return "", false
+	}
+	return toString(value), true
+}
+
+// durationVar returns a variable as a duration, see parseDuration
+func durationVar(vars map[string]interface{}, key string) (time.Duration, bool, error) {
+	value, exists := stringVar(vars, key)
+	if !exists {
+		return 0, false, nil
+	}
+	duration, err := parseDuration(value)
+	if err != nil {
+		return 0, true, fmt.Errorf("Invalid %v: %v", key, err)
+	}
+	return duration, true, nil
+}
+
+// parseDuration parses a number of seconds, such as 30 or 2.5, or a duration
+// such as 1m30s. An empty string is no duration
+func parseDuration(value string) (time.Duration, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, nil
+	}
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		if seconds < 0 {
+			return 0, fmt.Errorf("should not be negative, got: %v", value)
+		}
+		return time.Duration(seconds * float64(time.Second)), nil
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("should be seconds or a duration such as 1m30s, got: %v", value)
+	}
+	if duration < 0 {
+		return 0, fmt.Errorf("should not be negative, got: %v", value)
+	}
+	return duration, nil
+}
+
+// ParseExtraVars parses the values passed to --extra-vars. Each is either a
+// key=value pair, whose value is always a string, or a JSON or YAML mapping
+// such as {"ports": [80, 443]} for typed and nested values
+func ParseExtraVars(pairs []string) (map[string]interface{}, error) {
+	extraVars := make(map[string]interface{}, len(pairs))
+	for _, pair := range pairs {
+		if strings.HasPrefix(strings.TrimSpace(pair), "{") {
+			mapping := make(map[string]interface{}, 0)
+			if err := yaml.Unmarshal([]byte(pair), &mapping); err != nil {
+				return nil, fmt.Errorf("Extra vars %q aren't a valid mapping: %v", pair, err)
+			}
+			for key, value := range mapping {
+				extraVars[key] = value
+			}
+			continue
+		}
+		key, value, found := strings.Cut(pair, "=")
+		key = strings.TrimSpace(key)
+		if !found || key == "" {
+			return nil, fmt.Errorf("Extra var %q should be in the form key=value", pair)
+		}
+		extraVars[key] = value
+	}
+	return extraVars, nil
+}
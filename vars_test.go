@@ -0,0 +1,214 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+var precedenceInventory = []byte(`
+all:
+  children:
+    outer:
+      children:
+        inner:
+          hosts:
+            ssh1:
+              vars:
+                host_level: host
+          vars:
+            group_level: inner
+            host_level: inner
+      vars:
+        group_level: outer
+        outer_only: outer
+vars:
+  inventory_level: inventory
+  group_level: inventory
+`)
+
+var precedencePlaybook = []byte(`
+name: Precedence Playbook
+hosts:
+  - all
+vars:
+  host_level: play
+  play_level: play
+tasks:
+  - name: task one
+    cmd: whoami
+    vars:
+      play_level: task
+      task_level: task
+`)
+
+func TestResolveVarsPrecedence(t *testing.T) {
+	inventory, err := buildInventory(t, precedenceInventory)
+	if err != nil {
+		t.Fatalf("Failed to initialize inventory for test! %v\n", err)
+	}
+	hosts, err := inventory.ExecutionHosts([]string{"ssh1"})
+	if err != nil || len(hosts) != 1 {
+		t.Fatalf("Expected a single host, got %v, %v\n", hosts, err)
+	}
+	playbook := createTestPlaybook(t, precedencePlaybook)
+
+	resolver := NewVarResolver(map[string]interface{}{"task_level": "extra"})
+	resolver.Register(hosts[0], "registered_level", "registered")
+	vars := resolver.ResolveVars(hosts[0], playbook, playbook.Tasks[0])
+
+	expected := map[string]string{
+		"inventory_level":  "inventory",
+		"group_level":      "inner",
+		"outer_only":       "outer",
+		"host_level":       "play",
+		"play_level":       "task",
+		"task_level":       "extra",
+		"registered_level": "registered",
+	}
+	for varKey, expectedValue := range expected {
+		if vars[varKey] != expectedValue {
+			t.Fatalf("Expected %v to resolve to %v, got %v\n", varKey, expectedValue, vars[varKey])
+		}
+	}
+	if hosts[0].Vars["host_level"] != "host" {
+		t.Fatalf("ResolveVars shouldn't modify the host's vars: %v\n", hosts[0].Vars)
+	}
+}
+
+func TestParseExtraVars(t *testing.T) {
+	extraVars, err := ParseExtraVars([]string{"service=nginx", "args=a=b"})
+	if err != nil {
+		t.Fatalf("Received error when parsing extra vars: %v\n", err)
+	}
+	if extraVars["service"] != "nginx" || extraVars["args"] != "a=b" {
+		t.Fatalf("Extra vars parsed incorrectly: %v\n", extraVars)
+	}
+	if _, err := ParseExtraVars([]string{"novalue"}); err == nil {
+		t.Fatalf("Expected an error for an extra var without a value\n")
+	}
+}
+
+var typedInventory = []byte(`
+all:
+  hosts:
+    ssh1:
+      vars:
+        port: 2222
+        become: true
+        ports: [80, 443]
+        users:
+          admin:
+            shell: /bin/zsh
+  vars:
+    users:
+      admin:
+        uid: 1000
+        shell: /bin/bash
+      deploy:
+        uid: 1001
+`)
+
+func TestTypedInventoryVars(t *testing.T) {
+	inventory, err := buildInventory(t, typedInventory)
+	if err != nil {
+		t.Fatalf("Failed to initialize inventory for test! %v\n", err)
+	}
+	hosts, err := inventory.ExecutionHosts([]string{"ssh1"})
+	if err != nil || len(hosts) != 1 {
+		t.Fatalf("Expected a single host, got %v, %v\n", hosts, err)
+	}
+	vars := hosts[0].Vars
+	if vars["port"] != 2222 || vars["become"] != true {
+		t.Fatalf("Scalar vars lost their types: %#v\n", vars)
+	}
+	if ports, ok := vars["ports"].([]interface{}); !ok || len(ports) != 2 {
+		t.Fatalf("List var wasn't a list: %#v\n", vars["ports"])
+	}
+	users := vars["users"].(map[string]interface{})
+	if _, exists := users["deploy"]; exists {
+		t.Fatalf("Host users should replace group users by default: %#v\n", users)
+	}
+	if port, _ := stringVar(vars, "port"); port != "2222" {
+		t.Fatalf("stringVar should format numbers, got %v\n", port)
+	}
+	rendered, err := renderTemplate("cmd", "{{ .users.admin.shell }} {{ .ports | join \",\" }}", vars)
+	if err != nil || rendered != "/bin/zsh 80,443" {
+		t.Fatalf("Nested vars weren't rendered: %v, %v\n", rendered, err)
+	}
+}
+
+func TestResolveVarsDeepMerge(t *testing.T) {
+	inventory, err := buildInventory(t, typedInventory)
+	if err != nil {
+		t.Fatalf("Failed to initialize inventory for test! %v\n", err)
+	}
+	hosts, err := inventory.ExecutionHosts([]string{"ssh1"})
+	if err != nil || len(hosts) != 1 {
+		t.Fatalf("Expected a single host, got %v, %v\n", hosts, err)
+	}
+	playbook := Playbook{
+		Vars: map[string]interface{}{
+			"users": map[string]interface{}{
+				"admin": map[string]interface{}{"uid": 0},
+			},
+		},
+		VarMerge: map[string]string{
+			HostVarsStep: DeepVarMerge,
+			PlayVarsStep: DeepVarMerge,
+		},
+	}
+	vars := NewVarResolver(nil).ResolveVars(hosts[0], playbook, CommandTask{})
+	users := vars["users"].(map[string]interface{})
+	admin := users["admin"].(map[string]interface{})
+	if admin["uid"] != 0 || admin["shell"] != "/bin/zsh" {
+		t.Fatalf("Nested maps weren't deep merged: %#v\n", admin)
+	}
+	if _, exists := users["deploy"]; !exists {
+		t.Fatalf("Deep merge dropped inventory users: %#v\n", users)
+	}
+	inventoryUsers := inventory.All.Vars["users"].(map[string]interface{})
+	if inventoryUsers["admin"].(map[string]interface{})["uid"] != 1000 {
+		t.Fatalf("Deep merge modified the inventory's vars: %#v\n", inventoryUsers)
+	}
+
+	if err := validateVarMerge(map[string]string{"play": "append"}); err == nil {
+		t.Fatalf("Expected an error for an unknown merge behaviour\n")
+	}
+}
+
+func TestParseExtraVarsMapping(t *testing.T) {
+	extraVars, err := ParseExtraVars([]string{`{"ports": [80, 443], "debug": true}`})
+	if err != nil {
+		t.Fatalf("Received error when parsing extra vars: %v\n", err)
+	}
+	if extraVars["debug"] != true {
+		t.Fatalf("Extra vars mapping lost its types: %#v\n", extraVars)
+	}
+	if ports, ok := extraVars["ports"].([]interface{}); !ok || len(ports) != 2 {
+		t.Fatalf("Extra vars list wasn't a list: %#v\n", extraVars["ports"])
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	cases := map[string]time.Duration{
+		"":      0,
+		"30":    30 * time.Second,
+		"2.5":   2500 * time.Millisecond,
+		"1m30s": 90 * time.Second,
+	}
+	for value, expected := range cases {
+		duration, err := parseDuration(value)
+		if err != nil || duration != expected {
+			t.Fatalf("Expected %v to be %v, got %v %v\n", value, expected, duration, err)
+		}
+	}
+	for _, value := range []string{"-1", "soon", "-5s"} {
+		if _, err := parseDuration(value); err == nil {
+			t.Fatalf("Expected an error parsing %v\n", value)
+		}
+	}
+	duration, exists, err := durationVar(map[string]interface{}{"connect_timeout": 10}, "connect_timeout")
+	if err != nil || !exists || duration != 10*time.Second {
+		t.Fatalf("Expected a number var to be seconds, got %v %v %v\n", duration, exists, err)
+	}
+}